@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/akerouanton/go-xpc/pkg/xpc"
 )
@@ -16,9 +20,12 @@ type AddResponse struct {
 	Result int64
 }
 
+var peerRequirement string
+
 func runClient() error {
 	var method string
-	flag.StringVar(&method, "method", "", "method: ping, add or panic")
+	flag.StringVar(&method, "method", "", "method: ping, add, rpc, oneway or panic")
+	flag.StringVar(&peerRequirement, "peer-requirement", "", "code signing requirement that the daemon should satisfy")
 	flag.Parse()
 
 	switch method {
@@ -30,9 +37,18 @@ func runClient() error {
 		if err := callAdd(); err != nil {
 			return err
 		}
+	case "rpc":
+		if err := callRPC(); err != nil {
+			return err
+		}
+	case "oneway":
+		if err := callOneWay(); err != nil {
+			return err
+		}
 	case "panic":
-		if err := callPanic(true); err == nil {
-			return fmt.Errorf("expected callPanic to return an error")
+		var remoteErr *xpc.RemoteError
+		if err := callPanic(true); !errors.As(err, &remoteErr) || remoteErr.Code != xpc.CodeInternal {
+			return fmt.Errorf("expected callPanic to return an internal error, got: %v", err)
 		}
 		if err := callPanic(false); err != nil {
 			return err
@@ -44,7 +60,7 @@ func runClient() error {
 }
 
 func callPing() error {
-	session, err := xpc.NewSession("com.foobar.daemon.ping")
+	session, err := newSession("com.foobar.daemon.ping")
 	if err != nil {
 		panic(err)
 	}
@@ -68,7 +84,7 @@ func callPing() error {
 }
 
 func callAdd() error {
-	session, err := xpc.NewSession("com.foobar.daemon.add")
+	session, err := newSession("com.foobar.daemon.add")
 	if err != nil {
 		return err
 	}
@@ -86,6 +102,67 @@ func callAdd() error {
 	return nil
 }
 
+// callOneWay sends a message that fails without waiting for a reply, and
+// checks that the daemon is still up by sending another message.
+func callOneWay() error {
+	session, err := newSession("com.foobar.daemon.add")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err := xpc.Send(session, AddRequest{FirstNumber: math.MaxInt64, SecondNumber: 1}); err != nil {
+		return err
+	}
+
+	reply, err := xpc.SendWaitReply[AddRequest, AddResponse](session, AddRequest{
+		FirstNumber:  1,
+		SecondNumber: 2,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(reply.Result)
+
+	return nil
+}
+
+func callRPC() error {
+	session, err := newSession("com.foobar.daemon.rpc")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	pong, err := xpc.CallContext[greetings, greetings](ctx, session, "ping", greetings{Message: "hello"})
+	if err != nil {
+		return err
+	}
+	if pong.Message != "pong" {
+		return fmt.Errorf("expected pong, got %s", pong.Message)
+	}
+
+	reply, err := xpc.Call[AddRequest, AddResponse](session, "add", AddRequest{
+		FirstNumber:  1,
+		SecondNumber: 2,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = xpc.Call[AddRequest, AddResponse](session, "sub", AddRequest{})
+	var remoteErr *xpc.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != xpc.CodeUnknownMethod {
+		return fmt.Errorf("expected an unknown method error, got: %v", err)
+	}
+
+	fmt.Println(reply.Result)
+
+	return nil
+}
+
 type PanicRequest struct {
 	Panic bool
 }
@@ -95,7 +172,7 @@ type PanicResponse struct {
 }
 
 func callPanic(panic bool) error {
-	session, err := xpc.NewSession("com.foobar.daemon.panic")
+	session, err := newSession("com.foobar.daemon.panic")
 	if err != nil {
 		return err
 	}
@@ -113,3 +190,9 @@ func callPanic(panic bool) error {
 
 	return nil
 }
+
+func newSession(service string) (*xpc.Session, error) {
+	return xpc.NewSessionWithOptions(service, xpc.SessionOptions{
+		PeerRequirement: peerRequirement,
+	})
+}
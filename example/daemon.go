@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"os"
-	"os/signal"
-	"unsafe"
+	"log/slog"
+	"math"
+	"time"
 
 	"github.com/akerouanton/go-xpc/pkg/xpc"
 )
@@ -15,74 +16,63 @@ func runDaemon() error {
 	flag.StringVar(&requirement, "requirement", "", "code signing requirement that the daemon should enforce")
 	flag.Parse()
 
-	srv, err := xpc.NewServer(
-		xpc.Listener{Name: "com.foobar.daemon.ping", Requirement: requirement, Handler: handlePing},
-		xpc.Listener{Name: "com.foobar.daemon.add", Requirement: requirement, Handler: handleAddRequest},
-		// This listener will simulate a panicking daemon, to test how the
-		// client handles that error mode.
-		xpc.Listener{Name: "com.foobar.daemon.panic", Requirement: requirement, Handler: handlePanic},
+	// The rpc service exposes multiple methods through a single Mach service.
+	router := xpc.NewRouter()
+	router.Handle("ping", xpc.HandleFunc(handlePing))
+	router.Handle("add", xpc.HandleFunc(handleAddRequest))
+
+	fmt.Println("Starting XPC server...")
+	err := xpc.ListenAndServe(
+		xpc.ServerOptions{
+			PanicHandler: handleServerPanic,
+			Middlewares:  []xpc.Middleware{xpc.AccessLog(slog.Default())},
+		},
+		xpc.Listener{Name: "com.foobar.daemon.rpc", Requirement: requirement, ContextHandler: router.Serve, MaxConcurrency: 4, Timeout: 5 * time.Second},
+		xpc.Listener{Name: "com.foobar.daemon.ping", Requirement: requirement, ContextHandler: xpc.HandleFunc(handlePing)},
+		xpc.Listener{Name: "com.foobar.daemon.add", Requirement: requirement, ContextHandler: xpc.HandleFunc(handleAddRequest)},
+		// This listener will simulate a panicking handler, to test how the
+		// server recovers and how the client handles that error mode.
+		xpc.Listener{Name: "com.foobar.daemon.panic", Requirement: requirement, ContextHandler: xpc.HandleFunc(handlePanic)},
 	)
 	if err != nil {
-		panic(fmt.Errorf("error creating server: %w", err))
+		return fmt.Errorf("error running server: %w", err)
 	}
-
-	go func() {
-		fmt.Println("Starting XPC server...")
-		srv.Run()
-		fmt.Println("XPC server stopped")
-	}()
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
-
-	fmt.Println("Waiting for interrupt signal")
-	<-sigCh
-
-	fmt.Println("Received interrupt signal -- stopping XPC server")
-	srv.Close()
+	fmt.Println("XPC server stopped")
 
 	return nil
 }
 
+func handleServerPanic(_ context.Context, info xpc.PanicInfo) {
+	fmt.Printf("%s: recovered from panic: %v\n%s", info.Service, info.Value, info.Stack)
+}
+
 type greetings struct {
 	Message string
 }
 
-func handlePing(session *xpc.Session, msg unsafe.Pointer) {
-	var req greetings
-	if err := xpc.Unmarshal(msg, &req); err != nil {
-		fmt.Printf("com.foobar.daemon.ping: unmarshal err: %+v\n", err)
-		return
-	}
-
+func handlePing(_ context.Context, _ *xpc.Session, req greetings) (greetings, error) {
 	fmt.Printf("[ping] Received message: %s\n", req.Message)
-	xpc.Reply(session, msg, greetings{Message: "pong"})
+	return greetings{Message: "pong"}, nil
 }
 
-func handleAddRequest(session *xpc.Session, msg unsafe.Pointer) {
-	var req AddRequest
-	if err := xpc.Unmarshal(msg, &req); err != nil {
-		fmt.Printf("com.foobar.daemon.add: unmarshal err: %+v\n", err)
-		return
-	}
+func handleAddRequest(_ context.Context, _ *xpc.Session, req AddRequest) (AddResponse, error) {
 	fmt.Printf("New message received: %+v\n", req)
 
+	if (req.SecondNumber > 0 && req.FirstNumber > math.MaxInt64-req.SecondNumber) ||
+		(req.SecondNumber < 0 && req.FirstNumber < math.MinInt64-req.SecondNumber) {
+		return AddResponse{}, xpc.Errorf(xpc.CodeInvalidRequest, "integer overflow")
+	}
+
 	resp := req.FirstNumber + req.SecondNumber
 	fmt.Printf("Sending response: %+v\n", resp)
 
-	xpc.Reply(session, msg, AddResponse{Result: resp})
+	return AddResponse{Result: resp}, nil
 }
 
-func handlePanic(session *xpc.Session, msg unsafe.Pointer) {
-	var req PanicRequest
-	if err := xpc.Unmarshal(msg, &req); err != nil {
-		fmt.Printf("com.foobar.daemon.panic: unmarshal err: %+v\n", err)
-		return
-	}
-
+func handlePanic(_ context.Context, _ *xpc.Session, req PanicRequest) (PanicResponse, error) {
 	if req.Panic {
 		panic("panic")
 	}
 
-	xpc.Reply(session, msg, PanicResponse{Message: "didn't panic"})
+	return PanicResponse{Message: "didn't panic"}, nil
 }
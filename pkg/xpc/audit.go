@@ -0,0 +1,311 @@
+package xpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditOptions configures the audit log of a [Server], which records every
+// request handled by its listeners. See [ServerOptions.Audit].
+type AuditOptions struct {
+	// Sink is where records are written. See [NewJSONAuditSink] and
+	// [OpenAuditFile].
+	Sink AuditSink
+	// Redact lists the fields removed from records before they're written:
+	// "method", "pid", "uid", "gid", "code_identity", "metadata", or
+	// "metadata.<key>" for a single metadata entry. Redacted fields are listed
+	// in [AuditRecord.Redacted]. Other names are rejected when the server is
+	// created.
+	Redact []string
+}
+
+// redactableFields are the names accepted by [AuditOptions.Redact], besides
+// "metadata.<key>".
+var redactableFields = []string{"method", "pid", "uid", "gid", "code_identity", "metadata"}
+
+// validate returns an error if o has no sink, or if it redacts an unknown
+// field.
+func (o *AuditOptions) validate() error {
+	if o.Sink == nil {
+		return errors.New("audit options must have a sink")
+	}
+	for _, field := range o.Redact {
+		if slices.Contains(redactableFields, field) {
+			continue
+		}
+		if key, ok := strings.CutPrefix(field, "metadata."); ok && key != "" {
+			continue
+		}
+		return fmt.Errorf("audit options: can't redact unknown field %q", field)
+	}
+	return nil
+}
+
+// AuditRecord describes a request received by a [Listener].
+type AuditRecord struct {
+	// Time is when the request started being processed.
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Method  string    `json:"method,omitempty"`
+	// PID, UID and GID identify the peer. They're omitted once redacted,
+	// such that a redacted UID isn't mistaken for root.
+	PID int     `json:"pid,omitempty"`
+	UID *uint32 `json:"uid,omitempty"`
+	GID *uint32 `json:"gid,omitempty"`
+	// CodeIdentity is the code signing identifier of the peer, if it's
+	// signed.
+	CodeIdentity string `json:"code_identity,omitempty"`
+	// Outcome is [AuditOutcomeOK] or [AuditOutcomeNoReply] if the request
+	// didn't fail, [AuditOutcomeRejected] if it was dropped because its peer
+	// was rejected, or the code of the error replied otherwise.
+	Outcome string `json:"outcome"`
+	// Latency is how long it took to process the request.
+	Latency  time.Duration `json:"latency_ns"`
+	Metadata Metadata      `json:"metadata,omitempty"`
+	// Redacted lists the fields removed from the record. See
+	// [AuditOptions.Redact].
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+const (
+	// AuditOutcomeOK is the outcome of requests that got a reply.
+	AuditOutcomeOK = "ok"
+	// AuditOutcomeNoReply is the outcome of requests that didn't get any
+	// reply, like messages sent with [Send].
+	AuditOutcomeNoReply = "no_reply"
+	// AuditOutcomeRejected is the outcome of requests dropped without a
+	// reply, because the OnConnect hook of the [Listener] rejected
+	// their peer.
+	AuditOutcomeRejected = "rejected"
+)
+
+const redactedValue = "<redacted>"
+
+// AuditSink receives audit records. It must be safe for concurrent use.
+type AuditSink interface {
+	WriteAudit(rec AuditRecord) error
+}
+
+// AuditSinkFunc adapts a function to the [AuditSink] interface.
+type AuditSinkFunc func(rec AuditRecord) error
+
+func (f AuditSinkFunc) WriteAudit(rec AuditRecord) error {
+	return f(rec)
+}
+
+// newAuditRecord returns the record of the request described by info, once
+// it's done being processed at time now.
+func newAuditRecord(info *RequestInfo, codeIdentity string, now time.Time) AuditRecord {
+	outcome := AuditOutcomeNoReply
+	if code := info.ErrorCode(); code != "" {
+		outcome = string(code)
+	} else if info.Replied() {
+		outcome = AuditOutcomeOK
+	}
+
+	uid, gid := info.Peer.EUID, info.Peer.EGID
+	return AuditRecord{
+		Time:         info.Received,
+		Service:      info.Service,
+		Method:       info.Method,
+		PID:          info.Peer.PID,
+		UID:          &uid,
+		GID:          &gid,
+		CodeIdentity: codeIdentity,
+		Outcome:      outcome,
+		Latency:      now.Sub(info.Received),
+		Metadata:     info.Metadata,
+	}
+}
+
+// redact removes the fields listed in o.Redact from rec, which must have
+// been validated. rec.Metadata is
+// copied before being modified, since it's shared with the [RequestInfo].
+func (o *AuditOptions) redact(rec *AuditRecord) {
+	copied := false
+	for _, field := range o.Redact {
+		switch field {
+		case "method":
+			rec.Method = ""
+		case "pid":
+			rec.PID = 0
+		case "uid":
+			rec.UID = nil
+		case "gid":
+			rec.GID = nil
+		case "code_identity":
+			rec.CodeIdentity = ""
+		case "metadata":
+			rec.Metadata = nil
+		default:
+			key, ok := strings.CutPrefix(field, "metadata.")
+			if !ok {
+				continue
+			}
+			if _, ok := rec.Metadata[key]; !ok {
+				continue
+			}
+			if !copied {
+				rec.Metadata = maps.Clone(rec.Metadata)
+				copied = true
+			}
+			rec.Metadata[key] = redactedValue
+		}
+		rec.Redacted = append(rec.Redacted, field)
+	}
+}
+
+// write redacts rec and passes it to the sink. Errors are logged with the
+// standard logger, as there's no one to return them to.
+func (o *AuditOptions) write(rec AuditRecord) {
+	o.redact(&rec)
+	if err := o.Sink.WriteAudit(rec); err != nil {
+		log.Printf("xpc: failed to write audit record: %v", err)
+	}
+}
+
+type jsonAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns an [AuditSink] writing records to w as JSON lines.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{w: w}
+}
+
+func (s *jsonAuditSink) WriteAudit(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// AuditFile is an [AuditSink] writing records as JSON lines to a file, which
+// is rotated once it reaches a maximum size: path is renamed to path.1, path.1
+// to path.2, and so on, up to the maximum number of backups.
+type AuditFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// OpenAuditFile opens the audit file at path, creating it if needed. Records
+// are appended to it. It's rotated before it exceeds maxSize bytes (0 means
+// no limit), and at most maxBackups rotated files are kept.
+func OpenAuditFile(path string, maxSize int64, maxBackups int) (*AuditFile, error) {
+	a := &AuditFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditFile) open() error {
+	// Audit records are sensitive, so only let the owner read them.
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+func (a *AuditFile) WriteAudit(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return os.ErrClosed
+	}
+	// The file might not have been reopened after a failed rotation.
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit file: %w", err)
+		}
+	}
+
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups, and moves the current file to the first one.
+// The file is reopened even if it couldn't be rotated, such that records keep
+// being written.
+func (a *AuditFile) rotate() error {
+	err := errors.Join(a.f.Close(), a.shift())
+	a.f = nil
+	return errors.Join(err, a.open())
+}
+
+func (a *AuditFile) shift() error {
+	if a.maxBackups <= 0 {
+		return os.Remove(a.path)
+	}
+
+	for i := a.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(a.path, a.path+".1")
+}
+
+// Close closes the audit file. Records written afterwards are rejected with
+// [os.ErrClosed].
+func (a *AuditFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package xpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuditRecord(t *testing.T) {
+	received := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := &RequestInfo{
+		Service:  "com.foobar.daemon",
+		Method:   "add",
+		Peer:     PeerInfo{PID: 42, EUID: 501, EGID: 20},
+		Received: received,
+	}
+
+	rec := newAuditRecord(info, "com.foobar.client", received.Add(time.Millisecond))
+	assert.Equal(t, AuditRecord{
+		Time:         received,
+		Service:      "com.foobar.daemon",
+		Method:       "add",
+		PID:          42,
+		UID:          ptr(uint32(501)),
+		GID:          ptr(uint32(20)),
+		CodeIdentity: "com.foobar.client",
+		Outcome:      AuditOutcomeNoReply,
+		Latency:      time.Millisecond,
+	}, rec)
+
+	info.beginReply()
+	info.endReply("", nil)
+	assert.Equal(t, AuditOutcomeOK, newAuditRecord(info, "", received).Outcome)
+
+	info = &RequestInfo{}
+	info.beginReply()
+	info.endReply(CodePermissionDenied, nil)
+	assert.Equal(t, string(CodePermissionDenied), newAuditRecord(info, "", received).Outcome)
+}
+
+func TestAuditRedact(t *testing.T) {
+	md := Metadata{"request_id": "1", "token": "s3cr3t"}
+	rec := AuditRecord{PID: 42, UID: ptr(uint32(501)), GID: ptr(uint32(20)), CodeIdentity: "com.foobar.client", Metadata: md}
+
+	opts := &AuditOptions{Redact: []string{"pid", "gid", "code_identity", "metadata.token", "metadata.missing"}}
+	opts.redact(&rec)
+
+	assert.Equal(t, 0, rec.PID)
+	assert.Equal(t, uint32(501), *rec.UID)
+	assert.Nil(t, rec.GID)
+	assert.Empty(t, rec.CodeIdentity)
+	assert.Equal(t, Metadata{"request_id": "1", "token": "<redacted>"}, rec.Metadata)
+	assert.Equal(t, []string{"pid", "gid", "code_identity", "metadata.token"}, rec.Redacted)
+	// The original metadata is left untouched.
+	assert.Equal(t, "s3cr3t", md["token"])
+
+	// Redacted IDs are omitted, rather than written as 0.
+	line, err := json.Marshal(rec)
+	require.NoError(t, err)
+	assert.NotContains(t, string(line), `"pid":`)
+	assert.NotContains(t, string(line), `"gid":`)
+	assert.Contains(t, string(line), `"uid":501`)
+}
+
+func TestAuditOptionsValidate(t *testing.T) {
+	sink := NewJSONAuditSink(io.Discard)
+	assert.EqualError(t, (&AuditOptions{}).validate(), "audit options must have a sink")
+	assert.NoError(t, (&AuditOptions{Sink: sink, Redact: []string{"uid", "metadata", "metadata.token"}}).validate())
+	assert.EqualError(t, (&AuditOptions{Sink: sink, Redact: []string{"euid"}}).validate(), `audit options: can't redact unknown field "euid"`)
+	assert.Error(t, (&AuditOptions{Sink: sink, Redact: []string{"metadata."}}).validate())
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+
+	require.NoError(t, sink.WriteAudit(AuditRecord{Service: "com.foobar.daemon", Outcome: AuditOutcomeOK}))
+	require.NoError(t, sink.WriteAudit(AuditRecord{Service: "com.foobar.daemon", Outcome: string(CodeBusy)}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &rec))
+	assert.Equal(t, "com.foobar.daemon", rec["service"])
+	assert.Equal(t, "busy", rec["outcome"])
+	assert.NotContains(t, rec, "method")
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rec := AuditRecord{Service: "com.foobar.daemon", Outcome: AuditOutcomeOK}
+	line, err := json.Marshal(rec)
+	require.NoError(t, err)
+
+	// Room for two records per file.
+	f, err := OpenAuditFile(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for i := 0; i < 7; i++ {
+		require.NoError(t, f.WriteAudit(rec))
+	}
+
+	countLines := func(path string) int {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return strings.Count(string(b), "\n")
+	}
+	assert.Equal(t, 1, countLines(path))
+	assert.Equal(t, 2, countLines(path+".1"))
+	assert.Equal(t, 2, countLines(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, f.WriteAudit(rec), os.ErrClosed)
+}
@@ -34,6 +34,10 @@ func Marshal(v any) (C.xpc_object_t, error) {
 }
 
 func marshalVal(val any) (C.xpc_object_t, error) {
+	if o, ok := val.(Object); ok {
+		return o.copyObject()
+	}
+
 	// Check if val implements error interface
 	if err, ok := val.(error); ok {
 		// If it's a struct or has fields we want to preserve, marshal it as a dictionary
@@ -105,6 +109,10 @@ func marshalVal(val any) (C.xpc_object_t, error) {
 }
 
 func marshalIntoDict(dst C.xpc_object_t, src any) error {
+	if o, ok := src.(Object); ok {
+		return o.copyInto(dst)
+	}
+
 	v := reflect.ValueOf(src)
 	vtype := v.Type()
 	for i := 0; i < vtype.NumField(); i++ {
@@ -113,10 +121,7 @@ func marshalIntoDict(dst C.xpc_object_t, src any) error {
 			continue
 		}
 
-		xpcKey := field.Tag.Get("xpc")
-		if xpcKey == "" {
-			xpcKey = field.Name
-		}
+		xpcKey := parseFieldTag(field).key
 		if strings.HasPrefix(xpcKey, "_") {
 			return fmt.Errorf("xpc key cannot start with underscore: %s", xpcKey)
 		}
@@ -131,6 +136,9 @@ func marshalIntoDict(dst C.xpc_object_t, src any) error {
 }
 
 func getXPCType(v interface{}) string {
+	if o, ok := v.(Object); ok {
+		v = (C.xpc_object_t)(o.ptr)
+	}
 	vv, ok := v.(C.xpc_object_t)
 	if !ok {
 		return ""
@@ -290,10 +298,7 @@ func unmarshalVal(obj C.xpc_object_t, typ reflect.Type) (interface{}, error) {
 			result := reflect.New(typ).Elem()
 			for i := 0; i < typ.NumField(); i++ {
 				field := typ.Field(i)
-				key := field.Tag.Get("xpc")
-				if key == "" {
-					key = field.Name
-				}
+				key := parseFieldTag(field).key
 				ckey := C.CString(key)
 				defer C.free(unsafe.Pointer(ckey))
 
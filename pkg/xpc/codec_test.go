@@ -293,6 +293,27 @@ func TestUnmarshalRoundTrip(t *testing.T) {
 				Name: strPtr("John Doe"),
 			},
 		},
+		{
+			name: "struct with tag options",
+			input: struct {
+				Password string `xpc:"password,secret"`
+				Token    string `xpc:",secret"`
+			}{
+				Password: "hunter2",
+				Token:    "s3cr3t",
+			},
+			target: new(struct {
+				Password string `xpc:"password"`
+				Token    string `xpc:"Token"`
+			}),
+			want: struct {
+				Password string `xpc:"password"`
+				Token    string `xpc:"Token"`
+			}{
+				Password: "hunter2",
+				Token:    "s3cr3t",
+			},
+		},
 		{
 			name: "embedded struct",
 			input: struct {
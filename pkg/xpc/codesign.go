@@ -0,0 +1,76 @@
+package xpc
+
+/*
+#import "codesign.h"
+
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -framework Security -framework CoreFoundation
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ErrRequirementNotSatisfied is returned when a peer doesn't satisfy a code
+// signing requirement.
+var ErrRequirementNotSatisfied = errors.New("peer doesn't satisfy the code signing requirement")
+
+// requirementError returns an error wrapping both [ErrRequirementNotSatisfied]
+// and err if err is the error XPC fails with when the peer doesn't satisfy the
+// code signing requirement of a session. Otherwise, it returns err as is.
+func requirementError(err error) error {
+	var richErr RichError
+	if errors.As(err, &richErr) && richErr.peerForbidden {
+		return fmt.Errorf("%w: %w", ErrRequirementNotSatisfied, err)
+	}
+	return err
+}
+
+// isPeerRequirementError reports whether richErr, an xpc_rich_error_t, is the
+// error XPC fails with when the peer of a session doesn't satisfy its code
+// signing requirement.
+func isPeerRequirementError(richErr unsafe.Pointer) bool {
+	return bool(C.is_peer_requirement_error((C.xpc_rich_error_t)(richErr)))
+}
+
+// checkRequirement checks whether the process identified by token satisfies
+// the code signing requirement.
+func checkRequirement(token AuditToken, requirement string) error {
+	creq := C.CString(requirement)
+	defer C.free(unsafe.Pointer(creq))
+
+	var ctoken C.audit_token_t
+	for i := range token {
+		ctoken.val[i] = C.uint(token[i])
+	}
+
+	switch status := C.check_requirement(&ctoken, creq); status {
+	case C.errSecSuccess:
+		return nil
+	case C.errSecCSReqFailed:
+		return ErrRequirementNotSatisfied
+	default:
+		return fmt.Errorf("failed to check code signing requirement: OSStatus %d", int(status))
+	}
+}
+
+// signingIdentifier returns the code signing identifier of the process
+// identified by token, or an empty string if it isn't signed.
+func signingIdentifier(token AuditToken) (string, error) {
+	var ctoken C.audit_token_t
+	for i := range token {
+		ctoken.val[i] = C.uint(token[i])
+	}
+
+	var cident *C.char
+	if status := C.copy_signing_identifier(&ctoken, &cident); status != C.errSecSuccess {
+		return "", fmt.Errorf("failed to get code signing identifier: OSStatus %d", int(status))
+	}
+	if cident == nil {
+		return "", nil
+	}
+	defer C.free(unsafe.Pointer(cident))
+	return C.GoString(cident), nil
+}
@@ -0,0 +1,18 @@
+#import <xpc/xpc.h>
+#import <Security/Security.h>
+
+// check_requirement checks whether the process identified by token satisfies
+// the code signing requirement. It returns errSecSuccess if that's the case,
+// errSecCSReqFailed if it doesn't, or any other OSStatus if the check couldn't
+// be performed.
+OSStatus check_requirement(const audit_token_t *token, const char *requirement);
+
+// copy_signing_identifier stores the code signing identifier of the process
+// identified by token into identifier -- to be freed by the caller. It returns
+// errSecSuccess, or the OSStatus that prevented getting it. identifier is left
+// NULL if the process isn't signed.
+OSStatus copy_signing_identifier(const audit_token_t *token, char **identifier);
+
+// is_peer_requirement_error reports whether err is the error XPC fails with
+// when the peer of a session doesn't satisfy its code signing requirement.
+bool is_peer_requirement_error(xpc_rich_error_t err);
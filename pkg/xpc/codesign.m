@@ -0,0 +1,90 @@
+#import <string.h>
+#import "codesign.h"
+
+// copy_guest returns the code object of the process identified by token.
+static OSStatus copy_guest(const audit_token_t *token, SecCodeRef *code) {
+	CFDataRef tokenData = CFDataCreate(kCFAllocatorDefault, (const UInt8 *)token, sizeof(audit_token_t));
+	const void *keys[] = {kSecGuestAttributeAudit};
+	const void *values[] = {tokenData};
+	CFDictionaryRef attrs = CFDictionaryCreate(kCFAllocatorDefault, keys, values, 1,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFRelease(tokenData);
+
+	OSStatus status = SecCodeCopyGuestWithAttributes(NULL, attrs, kSecCSDefaultFlags, code);
+	CFRelease(attrs);
+	return status;
+}
+
+OSStatus check_requirement(const audit_token_t *token, const char *requirement) {
+	CFStringRef reqStr = CFStringCreateWithCString(kCFAllocatorDefault, requirement, kCFStringEncodingUTF8);
+	if (reqStr == NULL) {
+		return errSecParam;
+	}
+
+	SecRequirementRef req = NULL;
+	OSStatus status = SecRequirementCreateWithString(reqStr, kSecCSDefaultFlags, &req);
+	CFRelease(reqStr);
+	if (status != errSecSuccess) {
+		return status;
+	}
+
+	SecCodeRef code = NULL;
+	status = copy_guest(token, &code);
+	if (status == errSecSuccess) {
+		status = SecCodeCheckValidity(code, kSecCSDefaultFlags, req);
+		CFRelease(code);
+	}
+
+	CFRelease(req);
+	return status;
+}
+
+OSStatus copy_signing_identifier(const audit_token_t *token, char **identifier) {
+	*identifier = NULL;
+
+	SecCodeRef code = NULL;
+	OSStatus status = copy_guest(token, &code);
+	if (status != errSecSuccess) {
+		return status;
+	}
+
+	CFDictionaryRef info = NULL;
+	status = SecCodeCopySigningInformation((SecStaticCodeRef)code, kSecCSDefaultFlags, &info);
+	CFRelease(code);
+	if (status != errSecSuccess) {
+		return status;
+	}
+
+	CFStringRef ident = CFDictionaryGetValue(info, kSecCodeInfoIdentifier);
+	if (ident != NULL) {
+		CFIndex size = CFStringGetMaximumSizeForEncoding(CFStringGetLength(ident), kCFStringEncodingUTF8) + 1;
+		*identifier = malloc(size);
+		if (!CFStringGetCString(ident, *identifier, size, kCFStringEncodingUTF8)) {
+			free(*identifier);
+			*identifier = NULL;
+		}
+	}
+
+	CFRelease(info);
+	return errSecSuccess;
+}
+
+bool is_peer_requirement_error(xpc_rich_error_t err) {
+	// Failing the requirement is permanent: retrying would reach the same peer.
+	if (xpc_rich_error_can_retry(err)) {
+		return false;
+	}
+
+	// Rich errors don't expose the error they wrap, only their description,
+	// which embeds the one of XPC_ERROR_PEER_CODE_SIGNING_REQUIREMENT. Take it
+	// from that error, rather than hardcoding it.
+	const char *forbidden = xpc_dictionary_get_string(XPC_ERROR_PEER_CODE_SIGNING_REQUIREMENT, XPC_ERROR_KEY_DESCRIPTION);
+	if (forbidden == NULL) {
+		return false;
+	}
+
+	char *desc = xpc_rich_error_copy_description(err);
+	bool match = desc != NULL && strstr(desc, forbidden) != NULL;
+	free(desc);
+	return match;
+}
@@ -0,0 +1,24 @@
+package xpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequirementError(t *testing.T) {
+	forbidden := RichError{Err: errors.New("forbidden"), peerForbidden: true}
+
+	err := requirementError(fmt.Errorf("failed to activate session: %w", forbidden))
+	assert.ErrorIs(t, err, ErrRequirementNotSatisfied)
+	assert.ErrorAs(t, err, &RichError{})
+
+	other := RichError{Err: errors.New("Connection invalid"), CanRetry: true}
+	assert.Equal(t, other, requirementError(other))
+	// Only the identity of the error matters, not its description.
+	described := RichError{Err: errors.New(`<dictionary: 0x1> { "XPCErrorDescription" => "Peer Forbidden" }`)}
+	assert.Equal(t, described, requirementError(described))
+	assert.NoError(t, requirementError(nil))
+}
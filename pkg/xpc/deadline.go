@@ -0,0 +1,41 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"context"
+	"time"
+	"unsafe"
+)
+
+// deadlineKey is the reserved key under which the deadline of the client's
+// context is sent, as an XPC date. Servers use it to bound the context passed
+// to the [ContextHandler].
+const deadlineKey = "_deadline"
+
+// setDeadline stores the deadline of ctx, if any, into payload.
+func setDeadline(ctx context.Context, payload C.xpc_object_t) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	ckey := C.CString(deadlineKey)
+	defer C.free(unsafe.Pointer(ckey))
+	C.xpc_dictionary_set_date(payload, ckey, C.int64_t(deadline.UnixNano()))
+}
+
+// messageDeadline returns the deadline set by the client that sent msg.
+func messageDeadline(msg unsafe.Pointer) (time.Time, bool) {
+	ckey := C.CString(deadlineKey)
+	defer C.free(unsafe.Pointer(ckey))
+
+	v := C.xpc_dictionary_get_value((C.xpc_object_t)(msg), ckey)
+	if v == nil || C.xpc_get_type(v) != C.XPC_TYPE_DATE {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(C.xpc_date_get_value(v))), true
+}
@@ -0,0 +1,253 @@
+package xpc
+
+/*
+#import "describe.h"
+
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// maxDescribedData is the number of bytes printed for data objects. Longer
+// data is truncated.
+const maxDescribedData = 32
+
+// Describe returns a human-readable, indented representation of an XPC
+// object tree, with the type of every value:
+//
+//	dictionary {
+//	  "age": int64 30
+//	  "name": string "John Doe"
+//	  "tags": array [
+//	    string "admin"
+//	  ]
+//	}
+//
+// v is either a message received by a [Handler], as an unsafe.Pointer, or a
+// Go value which is passed through [Marshal] first. Dictionary keys are
+// sorted.
+//
+// File descriptors are shown with the path they refer to, or with their XPC
+// description if they have none, like sockets and pipes.
+//
+// Fields tagged as secret aren't redacted; use [Format] to log Go values.
+func Describe(v any) string {
+	return describe(v, false)
+}
+
+// DescribeCompact is like [Describe], but returns a single-line, JSON-like
+// representation. Values that don't have a JSON equivalent are written
+// between angle brackets, along with their type:
+//
+//	{"age":30,"created":<date 2024-01-02T03:04:05Z>,"name":"John Doe"}
+func DescribeCompact(v any) string {
+	return describe(v, true)
+}
+
+func describe(v any, compact bool) string {
+	obj, release, err := toXPCObject(v)
+	if err != nil {
+		return fmt.Sprintf("<invalid: %v>", err)
+	}
+	defer release()
+
+	var sb strings.Builder
+	if compact {
+		describeCompact(&sb, obj)
+	} else {
+		describePretty(&sb, obj, 0)
+	}
+	return sb.String()
+}
+
+// toXPCObject returns v if it's an XPC object, or marshals it otherwise.
+// release must be called once the object isn't needed anymore.
+func toXPCObject(v any) (_ C.xpc_object_t, release func(), _ error) {
+	switch v := v.(type) {
+	case unsafe.Pointer:
+		return (C.xpc_object_t)(v), func() {}, nil
+	case C.xpc_object_t:
+		return v, func() {}, nil
+	}
+
+	obj, err := Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return obj, func() {
+		if obj != nil {
+			C.xpc_release(obj)
+		}
+	}, nil
+}
+
+func describePretty(sb *strings.Builder, obj C.xpc_object_t, depth int) {
+	if obj == nil {
+		sb.WriteString("<nil>")
+		return
+	}
+
+	indent := strings.Repeat("  ", depth+1)
+	switch C.xpc_get_type(obj) {
+	case C.XPC_TYPE_DICTIONARY:
+		keys := dictKeys(obj)
+		if len(keys) == 0 {
+			sb.WriteString("dictionary {}")
+			return
+		}
+		sb.WriteString("dictionary {\n")
+		for _, k := range keys {
+			sb.WriteString(indent)
+			sb.WriteString(strconv.Quote(k))
+			sb.WriteString(": ")
+			describePretty(sb, dictValue(obj, k), depth+1)
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(indent[2:])
+		sb.WriteByte('}')
+	case C.XPC_TYPE_ARRAY:
+		count := int(C.xpc_array_get_count(obj))
+		if count == 0 {
+			sb.WriteString("array []")
+			return
+		}
+		sb.WriteString("array [\n")
+		for i := 0; i < count; i++ {
+			sb.WriteString(indent)
+			describePretty(sb, C.xpc_array_get_value(obj, C.size_t(i)), depth+1)
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(indent[2:])
+		sb.WriteByte(']')
+	case C.XPC_TYPE_STRING:
+		sb.WriteString("string ")
+		sb.WriteString(strconv.Quote(C.GoString(C.xpc_string_get_string_ptr(obj))))
+	case C.XPC_TYPE_DATA:
+		fmt.Fprintf(sb, "data (%d bytes) %s", int(C.xpc_data_get_length(obj)), describeData(obj))
+	case C.XPC_TYPE_NULL:
+		sb.WriteString("null")
+	default:
+		sb.WriteString(typeName(obj))
+		sb.WriteByte(' ')
+		sb.WriteString(describeScalar(obj))
+	}
+}
+
+func describeCompact(sb *strings.Builder, obj C.xpc_object_t) {
+	if obj == nil {
+		sb.WriteString("null")
+		return
+	}
+
+	switch C.xpc_get_type(obj) {
+	case C.XPC_TYPE_DICTIONARY:
+		sb.WriteByte('{')
+		for i, k := range dictKeys(obj) {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(strconv.Quote(k))
+			sb.WriteByte(':')
+			describeCompact(sb, dictValue(obj, k))
+		}
+		sb.WriteByte('}')
+	case C.XPC_TYPE_ARRAY:
+		sb.WriteByte('[')
+		for i := 0; i < int(C.xpc_array_get_count(obj)); i++ {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			describeCompact(sb, C.xpc_array_get_value(obj, C.size_t(i)))
+		}
+		sb.WriteByte(']')
+	case C.XPC_TYPE_STRING:
+		sb.WriteString(strconv.Quote(C.GoString(C.xpc_string_get_string_ptr(obj))))
+	case C.XPC_TYPE_NULL:
+		sb.WriteString("null")
+	case C.XPC_TYPE_BOOL, C.XPC_TYPE_INT64, C.XPC_TYPE_UINT64, C.XPC_TYPE_DOUBLE:
+		sb.WriteString(describeScalar(obj))
+	case C.XPC_TYPE_DATA:
+		fmt.Fprintf(sb, "<data %s>", describeData(obj))
+	default:
+		fmt.Fprintf(sb, "<%s %s>", typeName(obj), describeScalar(obj))
+	}
+}
+
+// describeScalar returns the value of obj, which isn't a container.
+func describeScalar(obj C.xpc_object_t) string {
+	switch C.xpc_get_type(obj) {
+	case C.XPC_TYPE_BOOL:
+		return strconv.FormatBool(bool(C.xpc_bool_get_value(obj)))
+	case C.XPC_TYPE_INT64:
+		return strconv.FormatInt(int64(C.xpc_int64_get_value(obj)), 10)
+	case C.XPC_TYPE_UINT64:
+		return strconv.FormatUint(uint64(C.xpc_uint64_get_value(obj)), 10)
+	case C.XPC_TYPE_DOUBLE:
+		return strconv.FormatFloat(float64(C.xpc_double_get_value(obj)), 'g', -1, 64)
+	case C.XPC_TYPE_DATE:
+		return time.Unix(0, int64(C.xpc_date_get_value(obj))).UTC().Format(time.RFC3339Nano)
+	case C.XPC_TYPE_UUID:
+		return formatUUID(C.GoBytes(unsafe.Pointer(C.xpc_uuid_get_bytes(obj)), 16))
+	case C.XPC_TYPE_FD:
+		buf := (*C.char)(C.malloc(C.MAXPATHLEN))
+		defer C.free(unsafe.Pointer(buf))
+		if C.fd_copy_path(obj, buf) != 0 {
+			return describeObject(obj)
+		}
+		return strconv.Quote(C.GoString(buf))
+	default:
+		return describeObject(obj)
+	}
+}
+
+// describeObject returns the description of obj made by XPC.
+func describeObject(obj C.xpc_object_t) string {
+	desc := C.xpc_copy_description(obj)
+	defer C.free(unsafe.Pointer(desc))
+	return C.GoString(desc)
+}
+
+// describeData returns the hexadecimal representation of the bytes of obj, a
+// data object, truncated to maxDescribedData bytes.
+func describeData(obj C.xpc_object_t) string {
+	length := int(C.xpc_data_get_length(obj))
+	b := C.GoBytes(C.xpc_data_get_bytes_ptr(obj), C.int(min(length, maxDescribedData)))
+	if length > maxDescribedData {
+		return hex.EncodeToString(b) + "..."
+	}
+	return hex.EncodeToString(b)
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return strings.ToUpper(s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32])
+}
+
+func typeName(obj C.xpc_object_t) string {
+	return C.GoString(C.xpc_type_get_name(C.xpc_get_type(obj)))
+}
+
+// dictKeys returns the keys of the XPC dictionary obj, sorted.
+func dictKeys(obj C.xpc_object_t) []string {
+	var keys []string
+	dictForEach(obj, func(key string, _ C.xpc_object_t) bool {
+		keys = append(keys, key)
+		return true
+	})
+	slices.Sort(keys)
+	return keys
+}
+
+func dictValue(obj C.xpc_object_t, key string) C.xpc_object_t {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	return C.xpc_dictionary_get_value(obj, ckey)
+}
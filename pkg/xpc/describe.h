@@ -0,0 +1,7 @@
+#import <sys/param.h>
+#import <xpc/xpc.h>
+
+// fd_copy_path stores the path of the file descriptor carried by fd into buf,
+// which must be at least MAXPATHLEN bytes long. It returns 0 on success, or -1
+// if the descriptor has no path, like sockets and pipes.
+int fd_copy_path(xpc_object_t fd, char *buf);
@@ -0,0 +1,14 @@
+#import <fcntl.h>
+#import <unistd.h>
+#import "describe.h"
+
+int fd_copy_path(xpc_object_t fd, char *buf) {
+	int dup = xpc_fd_dup(fd);
+	if (dup == -1) {
+		return -1;
+	}
+
+	int ret = fcntl(dup, F_GETPATH, buf);
+	close(dup);
+	return ret == -1 ? -1 : 0;
+}
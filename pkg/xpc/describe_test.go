@@ -0,0 +1,88 @@
+package xpc
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedUser struct {
+	Name   string   `xpc:"name"`
+	Age    int      `xpc:"age"`
+	Score  float64  `xpc:"score"`
+	Admin  bool     `xpc:"admin"`
+	Groups []string `xpc:"groups"`
+	Quota  uint64   `xpc:"quota"`
+	Empty  []int    `xpc:"empty"`
+}
+
+func TestDescribe(t *testing.T) {
+	user := describedUser{
+		Name:   "John Doe",
+		Age:    30,
+		Score:  1.5,
+		Admin:  true,
+		Groups: []string{"staff", "admin"},
+		Quota:  42,
+	}
+
+	assert.Equal(t, `dictionary {
+  "admin": bool true
+  "age": int64 30
+  "empty": array []
+  "groups": array [
+    string "staff"
+    string "admin"
+  ]
+  "name": string "John Doe"
+  "quota": uint64 42
+  "score": double 1.5
+}`, Describe(user))
+
+	assert.Equal(t, `{"admin":true,"age":30,"empty":[],"groups":["staff","admin"],"name":"John Doe","quota":42,"score":1.5}`, DescribeCompact(user))
+}
+
+func TestDescribeMessage(t *testing.T) {
+	obj, err := Marshal(struct {
+		Nested struct {
+			Value string `xpc:"value"`
+		} `xpc:"nested"`
+	}{})
+	require.NoError(t, err)
+
+	assert.Equal(t, `dictionary {
+  "nested": dictionary {
+    "value": string ""
+  }
+}`, Describe(unsafe.Pointer(obj)))
+	assert.Equal(t, `{"nested":{"value":""}}`, DescribeCompact(unsafe.Pointer(obj)))
+}
+
+func TestDescribeFD(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "xpc-describe-fd")
+	require.NoError(t, err)
+	defer f.Close()
+
+	desc := DescribeCompact(struct{ File FD }{File: FD(f.Fd())})
+	assert.Contains(t, desc, `{"File":{"_fd":<fd "`)
+	assert.Contains(t, desc, "xpc-describe-fd")
+
+	// Pipes have no path, so they're shown with their XPC description.
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	desc = DescribeCompact(struct{ File FD }{File: FD(r.Fd())})
+	assert.Contains(t, desc, `{"File":{"_fd":<fd `)
+	assert.NotContains(t, desc, `<fd "`)
+}
+
+func TestDescribeInvalid(t *testing.T) {
+	assert.Equal(t, "<nil>", Describe(nil))
+	assert.Equal(t, "null", DescribeCompact(nil))
+	assert.Contains(t, Describe(make(chan int)), "<invalid: unsupported type: chan>")
+}
@@ -0,0 +1,70 @@
+package xpc
+
+/*
+#import "dict.h"
+
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// dictForEach calls fn for each entry of the XPC dictionary dict, until fn
+// returns false. The order of the entries is unspecified.
+func dictForEach(dict C.xpc_object_t, fn func(key string, value C.xpc_object_t) bool) {
+	h := cgo.NewHandle(fn)
+	defer h.Delete()
+
+	C.dict_apply(dict, C.uintptr_t(h))
+}
+
+//export on_dict_entry
+func on_dict_entry(h C.uintptr_t, key *C.char, value C.xpc_object_t) C.bool {
+	fn := cgo.Handle(h).Value().(func(string, C.xpc_object_t) bool)
+	return C.bool(fn(C.GoString(key), value))
+}
+
+// setStringDict stores m into dict under key, as an XPC dictionary of strings.
+// It does nothing if m is empty.
+func setStringDict[M ~map[string]string](dict C.xpc_object_t, key string, m M) {
+	if len(m) == 0 {
+		return
+	}
+
+	value := C.xpc_dictionary_create_empty()
+	defer C.xpc_release(value)
+	for k, v := range m {
+		ck := C.CString(k)
+		cv := C.CString(v)
+		C.xpc_dictionary_set_string(value, ck, cv)
+		C.free(unsafe.Pointer(ck))
+		C.free(unsafe.Pointer(cv))
+	}
+
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	C.xpc_dictionary_set_value(dict, ckey, value)
+}
+
+// getStringDict returns the XPC dictionary of strings stored in dict under
+// key, or nil if there's none. Values that aren't strings are ignored.
+func getStringDict[M ~map[string]string](dict C.xpc_object_t, key string) M {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+
+	value := C.xpc_dictionary_get_value(dict, ckey)
+	if value == nil || C.xpc_get_type(value) != C.XPC_TYPE_DICTIONARY {
+		return nil
+	}
+
+	m := M{}
+	dictForEach(value, func(k string, v C.xpc_object_t) bool {
+		if C.xpc_get_type(v) == C.XPC_TYPE_STRING {
+			m[k] = C.GoString(C.xpc_string_get_string_ptr(v))
+		}
+		return true
+	})
+	return m
+}
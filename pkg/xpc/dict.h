@@ -0,0 +1,7 @@
+#import <xpc/xpc.h>
+
+// dict_apply calls on_dict_entry for each entry of dict, until it returns
+// false.
+void dict_apply(xpc_object_t dict, uintptr_t opaque);
+
+extern bool on_dict_entry(uintptr_t opaque, char *key, xpc_object_t value);
@@ -0,0 +1,7 @@
+#import "dict.h"
+
+void dict_apply(xpc_object_t dict, uintptr_t opaque) {
+	xpc_dictionary_apply(dict, ^bool(const char * _Nonnull key, xpc_object_t _Nonnull value) {
+		return on_dict_entry(opaque, (char *)key, value);
+	});
+}
@@ -15,6 +15,10 @@ import "C"
 type RichError struct {
 	Err      error
 	CanRetry bool
+
+	// peerForbidden is set if the peer doesn't satisfy the code signing
+	// requirement of the session. See [requirementError].
+	peerForbidden bool
 }
 
 func newRichError(richErr unsafe.Pointer) error {
@@ -27,8 +31,9 @@ func newRichError(richErr unsafe.Pointer) error {
 	defer C.free(unsafe.Pointer(desc))
 
 	return RichError{
-		Err:      errors.New(C.GoString(desc)),
-		CanRetry: bool(canRetry),
+		Err:           errors.New(C.GoString(desc)),
+		CanRetry:      bool(canRetry),
+		peerForbidden: isPeerRequirementError(richErr),
 	}
 }
 
@@ -39,3 +44,146 @@ func (r RichError) Error() string {
 func (r RichError) Unwrap() error {
 	return r.Err
 }
+
+// ErrorCode classifies the errors sent back to clients with [ReplyError].
+type ErrorCode string
+
+const (
+	// CodeUnknown is used for errors that don't carry a code.
+	CodeUnknown ErrorCode = "unknown"
+	// CodeInvalidRequest is used when a request couldn't be decoded.
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	// CodeInternal is used when the server failed to process a request --
+	// for instance, because the handler panicked.
+	CodeInternal ErrorCode = "internal"
+	// CodeUnknownMethod is used when a [Router] has no handler for the
+	// method called.
+	CodeUnknownMethod ErrorCode = "unknown_method"
+	// CodePermissionDenied is used when a peer isn't allowed to send a
+	// message.
+	CodePermissionDenied ErrorCode = "permission_denied"
+	// CodeBusy is used when a listener has too many messages waiting to be
+	// handled.
+	CodeBusy ErrorCode = "busy"
+	// CodeDeadlineExceeded is used when a handler didn't reply before its
+	// deadline. See [Listener].
+	CodeDeadlineExceeded ErrorCode = "deadline_exceeded"
+	// CodeRateLimited is used when a peer sends more messages than allowed
+	// by the [RateLimit] of a listener.
+	CodeRateLimited ErrorCode = "rate_limited"
+)
+
+// RemoteError is an error sent by a server with [ReplyError]. It's returned
+// by [SendWaitReply] and [Call] when the server replies with an error.
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+	// Details optionally carries additional, human-readable information.
+	Details string
+	// Retryable indicates whether the client can retry the request. See
+	// [RetryPolicy].
+	Retryable bool
+}
+
+// Errorf returns a [RemoteError] with the given code, and a message formatted
+// according to format.
+func Errorf(code ErrorCode, format string, args ...any) *RemoteError {
+	return &RemoteError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *RemoteError) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("remote error (%s): %s: %s", e.Code, e.Message, e.Details)
+	}
+	return fmt.Sprintf("remote error (%s): %s", e.Code, e.Message)
+}
+
+// errorReplyKey is the reserved key under which an [errorReply] is stored in
+// replies to failed requests. Message fields can't start with an underscore,
+// so it can't collide with them.
+const errorReplyKey = "_error_reply"
+
+// errorReply is the envelope of a [RemoteError] on the wire.
+type errorReply struct {
+	Code      string `xpc:"code"`
+	Message   string `xpc:"message"`
+	Details   string `xpc:"details"`
+	Retryable bool   `xpc:"retryable"`
+}
+
+// ReplyError sends an error reply to the original message. If err is, or
+// wraps, a [*RemoteError], it's sent as is. Otherwise, it's sent with
+// [CodeUnknown] and err's message.
+//
+// The client gets a [*RemoteError] from [SendWaitReply] or [Call]. Like with
+// [Reply], nothing is sent if original was sent with [Send]. err must not be
+// nil.
+func ReplyError(s *Session, original unsafe.Pointer, err error) error {
+	if err == nil {
+		return errors.New("xpc: ReplyError called with a nil error")
+	}
+
+	// xpc_dictionary_create_reply returns NULL for messages that don't expect
+	// a reply.
+	payload := C.xpc_dictionary_create_reply((C.xpc_object_t)(original))
+	if payload == nil {
+		return nil
+	}
+	defer C.xpc_release(payload)
+
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) {
+		remoteErr = &RemoteError{
+			Code:    CodeUnknown,
+			Message: err.Error(),
+		}
+	}
+
+	envelope, mErr := Marshal(errorReply{
+		Code:      string(remoteErr.Code),
+		Message:   remoteErr.Message,
+		Details:   remoteErr.Details,
+		Retryable: remoteErr.Retryable,
+	})
+	if mErr != nil {
+		return mErr
+	}
+	defer C.xpc_release(envelope)
+
+	ckey := C.CString(errorReplyKey)
+	defer C.free(unsafe.Pointer(ckey))
+	C.xpc_dictionary_set_value(payload, ckey, envelope)
+
+	return s.sendReply(payload, remoteErr.Code)
+}
+
+// decodeErrorReply returns the [RemoteError] stored in reply, or nil if reply
+// isn't an error reply.
+func decodeErrorReply(reply unsafe.Pointer) *RemoteError {
+	ckey := C.CString(errorReplyKey)
+	defer C.free(unsafe.Pointer(ckey))
+
+	envelope := C.xpc_dictionary_get_value((C.xpc_object_t)(reply), ckey)
+	if envelope == nil {
+		return nil
+	}
+
+	var e errorReply
+	if err := Unmarshal(unsafe.Pointer(envelope), &e); err != nil {
+		return &RemoteError{
+			Code:    CodeUnknown,
+			Message: "malformed error reply",
+			Details: err.Error(),
+		}
+	}
+
+	return &RemoteError{
+		Code:      ErrorCode(e.Code),
+		Message:   e.Message,
+		Details:   e.Details,
+		Retryable: e.Retryable,
+	}
+}
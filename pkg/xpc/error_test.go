@@ -0,0 +1,21 @@
+package xpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteError(t *testing.T) {
+	err := Errorf(CodePermissionDenied, "uid %d is not allowed", 501)
+	assert.Equal(t, "remote error (permission_denied): uid 501 is not allowed", err.Error())
+
+	err.Details = "only root can do that"
+	assert.Equal(t, "remote error (permission_denied): uid 501 is not allowed: only root can do that", err.Error())
+
+	var remoteErr *RemoteError
+	assert.True(t, errors.As(fmt.Errorf("call failed: %w", err), &remoteErr))
+	assert.Equal(t, CodePermissionDenied, remoteErr.Code)
+}
@@ -0,0 +1,214 @@
+package xpc
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// fieldTag is the parsed xpc struct tag of a field. The tag holds the key of
+// the field in the XPC dictionary, optionally followed by comma-separated
+// options:
+//
+//   - secret: the field is redacted by [Format] and [Redacted].
+//
+// An empty key defaults to the field name, like in `xpc:",secret"`.
+type fieldTag struct {
+	key    string
+	secret bool
+}
+
+func parseFieldTag(field reflect.StructField) fieldTag {
+	key, opts, _ := strings.Cut(field.Tag.Get("xpc"), ",")
+	tag := fieldTag{key: key}
+	if tag.key == "" {
+		tag.key = field.Name
+	}
+
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == "secret" {
+			tag.secret = true
+		}
+	}
+	return tag
+}
+
+const redacted = "<redacted>"
+
+// Format returns a human-readable representation of v, like fmt's %+v verb,
+// except that the fields tagged as secret are printed as <redacted>:
+//
+//	type Login struct {
+//		User     string `xpc:"user"`
+//		Password string `xpc:"password,secret"`
+//	}
+//
+//	xpc.Format(Login{User: "bob", Password: "hunter2"}) // {User:bob Password:<redacted>}
+//
+// Unlike fmt, pointers to structs, slices, arrays and maps are followed at
+// every depth, such that secret fields are redacted wherever they are. A
+// pointer, map or slice met again is printed as an address, which keeps
+// cyclic values from being formatted forever.
+//
+// It's meant for logging messages decoded by [Unmarshal]. See [Redacted] to
+// use it with fmt and log/slog.
+func Format(v any) string {
+	var sb strings.Builder
+	formatValue(&sb, reflect.ValueOf(v), true, map[visit]bool{})
+	return sb.String()
+}
+
+// visit identifies a pointer, map or slice already formatted. The type and
+// length tell apart pointers to a struct and to its first field, or slices
+// sharing the same backing array.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// visited reports whether v was already formatted, and records it otherwise.
+// Empty slices and pointers to zero-size values are never reported, since
+// they can share their address without being the same value.
+func visited(v reflect.Value, seen map[visit]bool) bool {
+	if (v.Kind() == reflect.Slice && v.Len() == 0) || (v.Kind() == reflect.Pointer && v.Type().Elem().Size() == 0) {
+		return false
+	}
+
+	key := visit{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	if seen[key] {
+		return true
+	}
+	seen[key] = true
+	return false
+}
+
+func formatValue(sb *strings.Builder, v reflect.Value, top bool, seen map[visit]bool) {
+	if !v.IsValid() {
+		sb.WriteString("<nil>")
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		sb.WriteByte('{')
+		vtype := v.Type()
+		first := true
+		for i := 0; i < vtype.NumField(); i++ {
+			field := vtype.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if !first {
+				sb.WriteByte(' ')
+			}
+			first = false
+
+			sb.WriteString(field.Name)
+			sb.WriteByte(':')
+			if parseFieldTag(field).secret {
+				sb.WriteString(redacted)
+				continue
+			}
+			formatValue(sb, v.Field(i), false, seen)
+		}
+		sb.WriteByte('}')
+	case reflect.Pointer:
+		if v.IsNil() {
+			sb.WriteString("<nil>")
+			return
+		}
+		// Dereference pointers at the top level, and pointers to composite
+		// types at any depth -- fmt only does the former.
+		if (top || isComposite(v.Elem().Kind())) && !visited(v, seen) {
+			sb.WriteByte('&')
+			formatValue(sb, v.Elem(), false, seen)
+			return
+		}
+		fmt.Fprintf(sb, "%p", v.Interface())
+	case reflect.Interface:
+		formatValue(sb, v.Elem(), false, seen)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			fmt.Fprintf(sb, "%v", v.Interface())
+			return
+		}
+		if v.Kind() == reflect.Slice && !v.IsNil() && visited(v, seen) {
+			fmt.Fprintf(sb, "%p", v.Interface())
+			return
+		}
+		sb.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			formatValue(sb, v.Index(i), false, seen)
+		}
+		sb.WriteByte(']')
+	case reflect.Map:
+		if !v.IsNil() && visited(v, seen) {
+			fmt.Fprintf(sb, "%p", v.Interface())
+			return
+		}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+		})
+		sb.WriteString("map[")
+		for i, k := range keys {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			formatValue(sb, k, false, seen)
+			sb.WriteByte(':')
+			formatValue(sb, v.MapIndex(k), false, seen)
+		}
+		sb.WriteByte(']')
+	default:
+		if v.CanInterface() {
+			fmt.Fprintf(sb, "%v", v.Interface())
+			return
+		}
+		fmt.Fprintf(sb, "%v", v)
+	}
+}
+
+func isComposite(k reflect.Kind) bool {
+	switch k {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	default:
+		return false
+	}
+}
+
+// Redacted wraps a message such that it's printed with [Format] by fmt and
+// log/slog, whatever the verb used:
+//
+//	log.Printf("received %v", xpc.Redacted{req})
+//	slog.Info("received", "req", xpc.Redacted{req})
+type Redacted struct {
+	Value any
+}
+
+func (r Redacted) String() string {
+	return Format(r.Value)
+}
+
+// Format implements [fmt.Formatter].
+func (r Redacted) Format(f fmt.State, _ rune) {
+	io.WriteString(f, Format(r.Value))
+}
+
+// LogValue implements [slog.LogValuer].
+func (r Redacted) LogValue() slog.Value {
+	return slog.StringValue(Format(r.Value))
+}
@@ -0,0 +1,107 @@
+package xpc
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFieldTag(t *testing.T) {
+	type msg struct {
+		Name     string
+		User     string `xpc:"user"`
+		Password string `xpc:"password,secret"`
+		Token    string `xpc:",secret"`
+		Other    string `xpc:"other,unknown"`
+	}
+
+	typ := reflect.TypeOf(msg{})
+	assert.Equal(t, fieldTag{key: "Name"}, parseFieldTag(typ.Field(0)))
+	assert.Equal(t, fieldTag{key: "user"}, parseFieldTag(typ.Field(1)))
+	assert.Equal(t, fieldTag{key: "password", secret: true}, parseFieldTag(typ.Field(2)))
+	assert.Equal(t, fieldTag{key: "Token", secret: true}, parseFieldTag(typ.Field(3)))
+	assert.Equal(t, fieldTag{key: "other"}, parseFieldTag(typ.Field(4)))
+}
+
+type credentials struct {
+	User     string `xpc:"user"`
+	Password string `xpc:"password,secret"`
+}
+
+type login struct {
+	Creds   credentials       `xpc:"creds"`
+	Tokens  []string          `xpc:"tokens,secret"`
+	Scopes  []string          `xpc:"scopes"`
+	Labels  map[string]string `xpc:"labels"`
+	Backup  *credentials      `xpc:"backup"`
+	Retries *int              `xpc:"retries"`
+	private string
+}
+
+func TestFormat(t *testing.T) {
+	retries := 3
+	msg := login{
+		Creds:   credentials{User: "bob", Password: "hunter2"},
+		Tokens:  []string{"s3cr3t"},
+		Scopes:  []string{"read", "write"},
+		Labels:  map[string]string{"b": "2", "a": "1"},
+		Backup:  &credentials{User: "alice", Password: "letmein"},
+		Retries: &retries,
+		private: "private",
+	}
+
+	got := Format(msg)
+	assert.Equal(t, "{Creds:{User:bob Password:<redacted>} Tokens:<redacted> Scopes:[read write] Labels:map[a:1 b:2] Backup:&{User:alice Password:<redacted>} Retries:"+fmt.Sprintf("%p", &retries)+"}", got)
+	assert.NotContains(t, got, "hunter2")
+
+	assert.Equal(t, "&{User:bob Password:<redacted>}", Format(&msg.Creds))
+	assert.Equal(t, "<nil>", Format(nil))
+	assert.Equal(t, "42", Format(42))
+	assert.Equal(t, "[1 2]", Format([]byte{1, 2}))
+}
+
+func TestFormatCycles(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	a := &node{Name: "a"}
+	a.Next = &node{Name: "b", Next: a}
+	assert.Equal(t, fmt.Sprintf("&{Name:a Next:&{Name:b Next:%p}}", a), Format(a))
+
+	m := map[string]any{"k": 1}
+	m["self"] = m
+	assert.Equal(t, fmt.Sprintf("map[k:1 self:%p]", m), Format(m))
+
+	s := []any{1, nil}
+	s[1] = s
+	assert.Equal(t, fmt.Sprintf("[1 %p]", s), Format(s))
+
+	// Empty values sharing an address aren't mistaken for cycles.
+	type empty struct{}
+	assert.Equal(t, "[[] [] &{} &{}]", Format([]any{[]int{}, []string{}, &empty{}, &empty{}}))
+}
+
+func TestRedacted(t *testing.T) {
+	creds := credentials{User: "bob", Password: "hunter2"}
+
+	for _, verb := range []string{"%v", "%+v", "%s", "%#v"} {
+		assert.Equal(t, "{User:bob Password:<redacted>}", fmt.Sprintf(verb, Redacted{creds}), verb)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	logger.Info("received", "req", Redacted{creds})
+	assert.Equal(t, "level=INFO msg=received req=\"{User:bob Password:<redacted>}\"\n", buf.String())
+}
@@ -0,0 +1,43 @@
+package xpc
+
+import (
+	"context"
+	"errors"
+	"unsafe"
+)
+
+// HandleFunc returns a [ContextHandler] that decodes incoming messages into a
+// Req, calls fn, and sends back the Resp it returns as a reply.
+//
+// If the message can't be decoded, or if fn returns an error, an error reply
+// is sent back to the client instead. See [ReplyError] -- fn can return a
+// [*RemoteError] to control the error code sent to the client.
+func HandleFunc[Req, Resp any](fn func(ctx context.Context, peer *Session, req Req) (Resp, error)) ContextHandler {
+	return func(ctx context.Context, peer *Session, msg unsafe.Pointer) {
+		var req Req
+		if err := Unmarshal(msg, &req); err != nil {
+			if info := RequestInfoFromContext(ctx); info != nil {
+				if m := info.serverMetrics(); m != nil {
+					m.DecodeError(info.Service)
+				}
+			}
+			ReplyError(peer, msg, Errorf(CodeInvalidRequest, "invalid request: %v", err))
+			return
+		}
+
+		resp, err := fn(ctx, peer, req)
+		if err != nil {
+			ReplyError(peer, msg, err)
+			return
+		}
+
+		if err := Reply(peer, msg, resp); err != nil {
+			// If the reply couldn't be sent, the peer is most likely gone.
+			// Otherwise, it couldn't be encoded and the client should know.
+			var richErr RichError
+			if !errors.As(err, &richErr) {
+				ReplyError(peer, msg, Errorf(CodeInternal, "failed to encode reply: %v", err))
+			}
+		}
+	}
+}
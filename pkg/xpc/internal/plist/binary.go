@@ -0,0 +1,549 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const binaryMagic = "bplist00"
+
+// trailerSize is the size of the trailer ending binary property lists.
+const trailerSize = 32
+
+// appleEpoch is the reference date of binary property lists dates.
+var appleEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// maxDateSeconds bounds the number of seconds from appleEpoch of decoded
+// dates, such that they can be converted to an int64 without overflowing.
+const maxDateSeconds = 1 << 62
+
+// Objects can be referenced multiple times, so a small binary property list
+// can decode into a huge tree. The number of decoded objects is bounded by
+// minDecodedObjects, or decodedObjectsFactor times the number of objects in
+// the property list, whichever is larger.
+const (
+	minDecodedObjects    = 1 << 16
+	decodedObjectsFactor = 16
+)
+
+// Object markers. The low nibble of markers holds the size of the object, or
+// 0xF if the size follows the marker as an integer object.
+const (
+	markerFalse    = 0x08
+	markerTrue     = 0x09
+	markerInt      = 0x10
+	markerReal     = 0x20
+	markerDate     = 0x33
+	markerData     = 0x40
+	markerASCII    = 0x50
+	markerUTF16    = 0x60
+	markerArray    = 0xA0
+	markerDict     = 0xD0
+	sizeFollows    = 0x0F
+	markerTypeMask = 0xF0
+)
+
+type binaryEncoder struct {
+	buf     bytes.Buffer
+	offsets []uint64
+	refSize int
+}
+
+func encodeBinary(v any) ([]byte, error) {
+	if err := checkValue(v); err != nil {
+		return nil, err
+	}
+
+	count := countObjects(v)
+	enc := &binaryEncoder{refSize: minBytes(uint64(count))}
+	enc.buf.WriteString(binaryMagic)
+	enc.writeObject(v)
+
+	offsetTableOffset := uint64(enc.buf.Len())
+	offsetSize := minBytes(offsetTableOffset)
+	for _, off := range enc.offsets {
+		enc.writeUint(off, offsetSize)
+	}
+
+	var trailer [trailerSize]byte
+	trailer[6] = byte(offsetSize)
+	trailer[7] = byte(enc.refSize)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(enc.offsets)))
+	binary.BigEndian.PutUint64(trailer[16:], 0)
+	binary.BigEndian.PutUint64(trailer[24:], offsetTableOffset)
+	enc.buf.Write(trailer[:])
+
+	return enc.buf.Bytes(), nil
+}
+
+// countObjects returns the number of objects needed to encode v. Objects
+// aren't deduplicated.
+func countObjects(v any) int {
+	switch v := v.(type) {
+	case []any:
+		n := 1
+		for _, item := range v {
+			n += countObjects(item)
+		}
+		return n
+	case map[string]any:
+		n := 1
+		for _, item := range v {
+			n += 1 + countObjects(item)
+		}
+		return n
+	default:
+		return 1
+	}
+}
+
+// writeObject writes v and the objects it references, and returns its index.
+// Objects are numbered in the order they're written, such that containers
+// can be written before their content, as long as the indices of their
+// content are known: they're the next ones.
+func (enc *binaryEncoder) writeObject(v any) int {
+	idx := len(enc.offsets)
+	enc.offsets = append(enc.offsets, uint64(enc.buf.Len()))
+
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		// The references to the keys come first, then the references to
+		// the values. Keys are single objects, but values can span many.
+		enc.writeMarker(markerDict, len(keys))
+		refs := make([]int, 0, 2*len(keys))
+		next := idx + 1
+		for range keys {
+			refs = append(refs, next)
+			next++
+		}
+		for _, k := range keys {
+			refs = append(refs, next)
+			next += countObjects(v[k])
+		}
+		for _, ref := range refs {
+			enc.writeUint(uint64(ref), enc.refSize)
+		}
+		for _, k := range keys {
+			enc.writeObject(k)
+		}
+		for _, k := range keys {
+			enc.writeObject(v[k])
+		}
+	case []any:
+		enc.writeMarker(markerArray, len(v))
+		next := idx + 1
+		for _, item := range v {
+			enc.writeUint(uint64(next), enc.refSize)
+			next += countObjects(item)
+		}
+		for _, item := range v {
+			enc.writeObject(item)
+		}
+	case string:
+		if isASCII(v) {
+			enc.writeMarker(markerASCII, len(v))
+			enc.buf.WriteString(v)
+			break
+		}
+		units := utf16.Encode([]rune(v))
+		enc.writeMarker(markerUTF16, len(units))
+		for _, u := range units {
+			enc.writeUint(uint64(u), 2)
+		}
+	case int64:
+		if v < 0 {
+			enc.buf.WriteByte(markerInt | 3)
+			enc.writeUint(uint64(v), 8)
+		} else {
+			enc.writeInt(uint64(v))
+		}
+	case uint64:
+		enc.writeInt(v)
+	case float64:
+		enc.buf.WriteByte(markerReal | 3)
+		enc.writeUint(math.Float64bits(v), 8)
+	case bool:
+		if v {
+			enc.buf.WriteByte(markerTrue)
+		} else {
+			enc.buf.WriteByte(markerFalse)
+		}
+	case []byte:
+		enc.writeMarker(markerData, len(v))
+		enc.buf.Write(v)
+	case time.Time:
+		// v.Sub(appleEpoch) saturates for dates more than 292 years away,
+		// so compute the seconds and nanoseconds separately.
+		secs := float64(v.Unix()-appleEpoch.Unix()) + float64(v.Nanosecond())/1e9
+		enc.buf.WriteByte(markerDate)
+		enc.writeUint(math.Float64bits(secs), 8)
+	}
+	return idx
+}
+
+// writeMarker writes the marker of an object, along with its size.
+func (enc *binaryEncoder) writeMarker(marker byte, size int) {
+	if size < sizeFollows {
+		enc.buf.WriteByte(marker | byte(size))
+		return
+	}
+	enc.buf.WriteByte(marker | sizeFollows)
+	enc.writeInt(uint64(size))
+}
+
+// writeInt writes a non-negative integer object. Integers larger than
+// math.MaxInt64 are written on 16 bytes, since 8-byte integers are signed.
+func (enc *binaryEncoder) writeInt(u uint64) {
+	if u > math.MaxInt64 {
+		enc.buf.WriteByte(markerInt | 4)
+		enc.writeUint(0, 8)
+		enc.writeUint(u, 8)
+		return
+	}
+
+	size := minBytes(u)
+	if size == 3 {
+		size = 4
+	} else if size > 4 {
+		size = 8
+	}
+	enc.buf.WriteByte(markerInt | byte(bitsLen(size)))
+	enc.writeUint(u, size)
+}
+
+func (enc *binaryEncoder) writeUint(u uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], u)
+	enc.buf.Write(b[8-size:])
+}
+
+// minBytes returns the number of bytes needed to store u, among 1, 2, 4 and
+// 8.
+func minBytes(u uint64) int {
+	switch {
+	case u <= math.MaxUint8:
+		return 1
+	case u <= math.MaxUint16:
+		return 2
+	case u <= math.MaxUint32:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// bitsLen returns log2(size), for size in 1, 2, 4 and 8.
+func bitsLen(size int) int {
+	switch size {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+type binaryDecoder struct {
+	data       []byte
+	offsets    []uint64
+	refSize    int
+	offsetSize int
+	// visiting holds the objects being decoded, to detect reference cycles.
+	visiting map[uint64]bool
+	// decoded counts the objects decoded so far, which can't exceed
+	// maxDecoded.
+	decoded    uint64
+	maxDecoded uint64
+}
+
+func decodeBinary(data []byte) (any, error) {
+	if len(data) < len(binaryMagic)+trailerSize {
+		return nil, errors.New("binary property list is too short")
+	}
+
+	trailer := data[len(data)-trailerSize:]
+	dec := &binaryDecoder{
+		data:       data,
+		offsetSize: int(trailer[6]),
+		refSize:    int(trailer[7]),
+		visiting:   map[uint64]bool{},
+	}
+	numObjects := binary.BigEndian.Uint64(trailer[8:])
+	topObject := binary.BigEndian.Uint64(trailer[16:])
+	offsetTableOffset := binary.BigEndian.Uint64(trailer[24:])
+
+	if !validIntSize(dec.offsetSize) || !validIntSize(dec.refSize) {
+		return nil, errors.New("invalid binary property list trailer")
+	}
+	tableEnd := uint64(len(data) - trailerSize)
+	if offsetTableOffset < uint64(len(binaryMagic)) || offsetTableOffset > tableEnd ||
+		numObjects > (tableEnd-offsetTableOffset)/uint64(dec.offsetSize) || topObject >= numObjects {
+		return nil, errors.New("invalid binary property list trailer")
+	}
+
+	dec.maxDecoded = max(minDecodedObjects, decodedObjectsFactor*numObjects)
+	dec.offsets = make([]uint64, numObjects)
+	for i := range dec.offsets {
+		pos := offsetTableOffset + uint64(i*dec.offsetSize)
+		off := readUint(data[pos : pos+uint64(dec.offsetSize)])
+		if off < uint64(len(binaryMagic)) || off >= offsetTableOffset {
+			return nil, fmt.Errorf("invalid offset for object %d", i)
+		}
+		dec.offsets[i] = off
+	}
+
+	return dec.object(topObject, 0)
+}
+
+// decodeDate returns the date secs seconds after appleEpoch. Dates more than
+// 292 years away from it can't be represented as a time.Duration, so the
+// seconds and nanoseconds are added separately.
+func decodeDate(secs float64) (time.Time, error) {
+	whole := math.Floor(secs)
+	if math.IsNaN(secs) || whole < -maxDateSeconds || whole > maxDateSeconds {
+		return time.Time{}, fmt.Errorf("date out of range: %v", secs)
+	}
+	nsecs := int64((secs - whole) * 1e9)
+	return time.Unix(appleEpoch.Unix()+int64(whole), nsecs).UTC(), nil
+}
+
+func validIntSize(size int) bool {
+	return size == 1 || size == 2 || size == 4 || size == 8
+}
+
+func readUint(b []byte) uint64 {
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u
+}
+
+// object decodes the object at index ref.
+func (dec *binaryDecoder) object(ref uint64, depth int) (any, error) {
+	if ref >= uint64(len(dec.offsets)) {
+		return nil, fmt.Errorf("invalid object reference %d", ref)
+	}
+	if depth > maxDepth {
+		return nil, errors.New("property list is nested too deeply")
+	}
+	if dec.visiting[ref] {
+		return nil, fmt.Errorf("reference cycle through object %d", ref)
+	}
+	dec.decoded++
+	if dec.decoded > dec.maxDecoded {
+		return nil, errors.New("property list references too many objects")
+	}
+	dec.visiting[ref] = true
+	defer delete(dec.visiting, ref)
+
+	pos := dec.offsets[ref]
+	marker := dec.data[pos]
+	pos++
+
+	switch marker {
+	case markerFalse:
+		return false, nil
+	case markerTrue:
+		return true, nil
+	case markerDate:
+		b, err := dec.read(pos, 8)
+		if err != nil {
+			return nil, err
+		}
+		return decodeDate(math.Float64frombits(readUint(b)))
+	}
+
+	switch marker & markerTypeMask {
+	case markerInt:
+		return dec.int(pos, marker)
+	case markerReal:
+		size := 1 << (marker & 0x0F)
+		b, err := dec.read(pos, uint64(size))
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 4:
+			return float64(math.Float32frombits(uint32(readUint(b)))), nil
+		case 8:
+			return math.Float64frombits(readUint(b)), nil
+		default:
+			return nil, fmt.Errorf("invalid real size %d", size)
+		}
+	case markerData:
+		size, pos, err := dec.size(pos, marker)
+		if err != nil {
+			return nil, err
+		}
+		b, err := dec.read(pos, size)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Clone(b), nil
+	case markerASCII:
+		size, pos, err := dec.size(pos, marker)
+		if err != nil {
+			return nil, err
+		}
+		b, err := dec.read(pos, size)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case markerUTF16:
+		size, pos, err := dec.size(pos, marker)
+		if err != nil {
+			return nil, err
+		}
+		b, err := dec.read(pos, 2*size)
+		if err != nil {
+			return nil, err
+		}
+		units := make([]uint16, size)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case markerArray:
+		size, pos, err := dec.size(pos, marker)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := dec.refs(pos, size)
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]any, len(refs))
+		for i, ref := range refs {
+			if arr[i], err = dec.object(ref, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case markerDict:
+		size, pos, err := dec.size(pos, marker)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := dec.refs(pos, 2*size)
+		if err != nil {
+			return nil, err
+		}
+		dict := make(map[string]any, size)
+		for i := uint64(0); i < size; i++ {
+			key, err := dec.object(refs[i], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key must be a string, got %T", key)
+			}
+			if dict[k], err = dec.object(refs[size+i], depth+1); err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("unsupported object marker 0x%02x", marker)
+	}
+}
+
+// int decodes an integer object whose marker is at pos-1.
+func (dec *binaryDecoder) int(pos uint64, marker byte) (any, error) {
+	size := uint64(1) << (marker & 0x0F)
+	b, err := dec.read(pos, size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch size {
+	case 1, 2, 4, 8:
+		// 1, 2 and 4-byte integers are unsigned, 8-byte ones are signed.
+		return int64(readUint(b)), nil
+	case 16:
+		// 16-byte integers are used for integers that don't fit in an int64.
+		// Only those that fit in a uint64 are supported.
+		if readUint(b[:8]) != 0 {
+			return nil, errors.New("integer overflows uint64")
+		}
+		return intValue(readUint(b[8:]), false)
+	default:
+		return nil, fmt.Errorf("invalid integer size %d", size)
+	}
+}
+
+// size returns the size of the object whose marker is at pos-1, and the
+// position of its content.
+func (dec *binaryDecoder) size(pos uint64, marker byte) (uint64, uint64, error) {
+	if marker&0x0F != sizeFollows {
+		return uint64(marker & 0x0F), pos, nil
+	}
+
+	b, err := dec.read(pos, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if b[0]&markerTypeMask != markerInt || b[0]&0x0F > 3 {
+		return 0, 0, errors.New("invalid object size")
+	}
+	n := uint64(1) << (b[0] & 0x0F)
+	sb, err := dec.read(pos+1, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Sizes are multiplied when computing the length of the content, so
+	// reject the ones that can't be right before they overflow.
+	size := readUint(sb)
+	if size > uint64(len(dec.data)) {
+		return 0, 0, errors.New("object out of bounds")
+	}
+	return size, pos + 1 + n, nil
+}
+
+func (dec *binaryDecoder) refs(pos, n uint64) ([]uint64, error) {
+	b, err := dec.read(pos, n*uint64(dec.refSize))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, n)
+	for i := range refs {
+		refs[i] = readUint(b[i*dec.refSize : (i+1)*dec.refSize])
+	}
+	return refs, nil
+}
+
+// read returns the n bytes at pos, or an error if they're out of bounds.
+func (dec *binaryDecoder) read(pos, n uint64) ([]byte, error) {
+	end := uint64(len(dec.data) - trailerSize)
+	if pos > end || n > end-pos {
+		return nil, errors.New("object out of bounds")
+	}
+	return dec.data[pos : pos+n], nil
+}
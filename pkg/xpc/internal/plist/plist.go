@@ -0,0 +1,97 @@
+// Package plist encodes and decodes Apple property lists, in both the XML and
+// binary formats.
+//
+// Property list values are represented with the following Go types:
+// map[string]any for dictionaries, []any for arrays, string, int64, uint64
+// (for integers larger than math.MaxInt64), float64, bool, []byte for data,
+// and time.Time for dates.
+package plist
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Format is the serialization format of a property list.
+type Format int
+
+const (
+	// XML is the XML format, as written by plutil -convert xml1.
+	XML Format = iota + 1
+	// Binary is the binary format, as written by plutil -convert binary1.
+	Binary
+)
+
+func (f Format) String() string {
+	switch f {
+	case XML:
+		return "xml1"
+	case Binary:
+		return "binary1"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// Encode returns the property list representation of v, in the given format.
+func Encode(v any, format Format) ([]byte, error) {
+	switch format {
+	case XML:
+		return encodeXML(v)
+	case Binary:
+		return encodeBinary(v)
+	default:
+		return nil, fmt.Errorf("unsupported format %v", format)
+	}
+}
+
+// Decode parses a property list, and returns its value along with the format
+// it's serialized in.
+func Decode(data []byte) (any, Format, error) {
+	if bytes.HasPrefix(data, []byte(binaryMagic)) {
+		v, err := decodeBinary(data)
+		return v, Binary, err
+	}
+	v, err := decodeXML(data)
+	return v, XML, err
+}
+
+// checkValue returns an error if v isn't a property list value.
+func checkValue(v any) error {
+	switch v := v.(type) {
+	case string, int64, uint64, float64, bool, []byte, time.Time:
+		return nil
+	case []any:
+		for _, item := range v {
+			if err := checkValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		for _, item := range v {
+			if err := checkValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported property list value %T", v)
+	}
+}
+
+// intValue returns an integer from its absolute value, and whether it's
+// negative.
+func intValue(u uint64, negative bool) (any, error) {
+	if negative {
+		if u > 1<<63 {
+			return nil, fmt.Errorf("integer -%d overflows int64", u)
+		}
+		return -int64(u-1) - 1, nil
+	}
+	if u > 1<<63-1 {
+		return u, nil
+	}
+	return int64(u), nil
+}
@@ -0,0 +1,226 @@
+package plist
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleValue() map[string]any {
+	many := make([]any, 20)
+	for i := range many {
+		many[i] = int64(i * 1000)
+	}
+
+	return map[string]any{
+		"Label":            "com.foobar.daemon",
+		"ProgramArguments": []any{"/usr/local/bin/daemon", "-requirement", `identifier "com.foobar" & <anchor>`},
+		"RunAtLoad":        true,
+		"KeepAlive":        false,
+		"Nice":             int64(-5),
+		"Big":              uint64(math.MaxUint64),
+		"MaxInt":           int64(math.MaxInt64),
+		"MinInt":           int64(math.MinInt64),
+		"Ratio":            0.25,
+		"Blob":             []byte{0, 1, 2, 0xFF},
+		"Created":          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"DistantFuture":    time.Date(4001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"DistantPast":      time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		"Unicode":          "héllo, 世界 🎉",
+		"Long":             strings.Repeat("x", 300),
+		"Many":             many,
+		"Empty":            map[string]any{},
+		"EmptyArray":       []any{},
+		"Nested": map[string]any{
+			"MachServices": map[string]any{
+				"com.foobar.daemon.ping": true,
+			},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{XML, Binary} {
+		t.Run(format.String(), func(t *testing.T) {
+			data, err := Encode(sampleValue(), format)
+			require.NoError(t, err)
+
+			got, gotFormat, err := Decode(data)
+			require.NoError(t, err)
+			assert.Equal(t, format, gotFormat)
+			assert.Equal(t, sampleValue(), got)
+		})
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	data, err := Encode(map[string]any{
+		"Label":     "a < b",
+		"RunAtLoad": true,
+		"Args":      []any{int64(1), 1.5},
+		"Empty":     []any{},
+	}, XML)
+	require.NoError(t, err)
+
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Args</key>
+	<array>
+		<integer>1</integer>
+		<real>1.5</real>
+	</array>
+	<key>Empty</key>
+	<array/>
+	<key>Label</key>
+	<string>a &lt; b</string>
+	<key>RunAtLoad</key>
+	<true/>
+</dict>
+</plist>
+`, string(data))
+}
+
+func TestDecodeXML(t *testing.T) {
+	got, format, err := Decode([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<!-- A comment -->
+	<key>Hex</key>
+	<integer>0x1F</integer>
+	<key>Data</key>
+	<data>
+	AAEC
+	/w==
+	</data>
+	<key>Inf</key>
+	<real>-infinity</real>
+	<key>Entity</key>
+	<string>&amp;&#x41;</string>
+	<key>EmptyString</key>
+	<string/>
+</dict>
+</plist>`))
+	require.NoError(t, err)
+	assert.Equal(t, XML, format)
+	assert.Equal(t, map[string]any{
+		"Hex":         int64(31),
+		"Data":        []byte{0, 1, 2, 0xFF},
+		"Inf":         math.Inf(-1),
+		"Entity":      "&A",
+		"EmptyString": "",
+	}, got)
+}
+
+// binarySample is {"a": 1} encoded as a binary property list, as described by
+// CFBinaryPList.c.
+var binarySample = []byte{
+	'b', 'p', 'l', 'i', 's', 't', '0', '0',
+	0xD1, 0x01, 0x02, // dict with 1 entry: key ref 1, value ref 2
+	0x51, 'a', // ASCII string of length 1
+	0x10, 0x01, // 1-byte integer
+	0x08, 0x0B, 0x0D, // offset table
+	0, 0, 0, 0, 0, 0, // unused
+	0x01,                   // offset size
+	0x01,                   // object ref size
+	0, 0, 0, 0, 0, 0, 0, 3, // number of objects
+	0, 0, 0, 0, 0, 0, 0, 0, // top object
+	0, 0, 0, 0, 0, 0, 0, 15, // offset table offset
+}
+
+func TestBinarySample(t *testing.T) {
+	got, format, err := Decode(binarySample)
+	require.NoError(t, err)
+	assert.Equal(t, Binary, format)
+	assert.Equal(t, map[string]any{"a": int64(1)}, got)
+
+	data, err := Encode(map[string]any{"a": int64(1)}, Binary)
+	require.NoError(t, err)
+	assert.Equal(t, binarySample, data)
+}
+
+// expandingPlist returns a binary property list of n arrays, each holding two
+// references to the next one, such that it decodes into 2^n objects.
+func expandingPlist(n int) []byte {
+	data := []byte(binaryMagic)
+	var offsets []byte
+	for i := 0; i < n; i++ {
+		offsets = append(offsets, byte(len(data)))
+		data = append(data, markerArray|2, byte(i+1), byte(i+1))
+	}
+	offsets = append(offsets, byte(len(data)))
+	data = append(data, markerTrue)
+
+	table := len(data)
+	data = append(data, offsets...)
+	trailer := make([]byte, trailerSize)
+	trailer[6], trailer[7] = 1, 1
+	binary.BigEndian.PutUint64(trailer[8:], uint64(n+1))
+	binary.BigEndian.PutUint64(trailer[24:], uint64(table))
+	return append(data, trailer...)
+}
+
+func TestDecodeExpanding(t *testing.T) {
+	// 2^15 objects are decoded fine.
+	_, _, err := Decode(expandingPlist(14))
+	require.NoError(t, err)
+
+	_, _, err = Decode(expandingPlist(40))
+	assert.EqualError(t, err, "property list references too many objects")
+}
+
+func TestDecodeBinaryDate(t *testing.T) {
+	got, err := decodeDate(-0.5)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2000, 12, 31, 23, 59, 59, 500000000, time.UTC), got)
+
+	for _, secs := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e300} {
+		_, err := decodeDate(secs)
+		assert.Error(t, err, secs)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cycle := append([]byte{}, binarySample...)
+	cycle[10] = 0x00 // the dict's value is the dict itself
+
+	badTrailer := append([]byte{}, binarySample...)
+	badTrailer[len(badTrailer)-9] = 0xFF // top object out of range
+
+	for name, data := range map[string][]byte{
+		"empty":            nil,
+		"not a plist":      []byte(`<foo/>`),
+		"unknown element":  []byte(`<plist><foo/></plist>`),
+		"bad integer":      []byte(`<plist><integer>abc</integer></plist>`),
+		"int64 overflow":   []byte(`<plist><integer>-9223372036854775809</integer></plist>`),
+		"missing key":      []byte(`<plist><dict><string>a</string></dict></plist>`),
+		"truncated XML":    []byte(`<plist><dict><key>a</key>`),
+		"truncated binary": binarySample[:20],
+		"cycle":            cycle,
+		"bad trailer":      badTrailer,
+		"too deep":         []byte("<plist>" + strings.Repeat("<array>", maxDepth+2) + "</plist>"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := Decode(data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	for _, format := range []Format{XML, Binary} {
+		_, err := Encode(map[string]any{"a": nil}, format)
+		assert.ErrorContains(t, err, "unsupported property list value <nil>")
+		_, err = Encode([]any{int32(1)}, format)
+		assert.ErrorContains(t, err, "unsupported property list value int32")
+	}
+	_, err := Encode("a", Format(0))
+	assert.Error(t, err)
+}
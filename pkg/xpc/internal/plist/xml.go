@@ -0,0 +1,327 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// maxDepth bounds the nesting of decoded property lists, such that malformed
+// input can't exhaust the stack.
+const maxDepth = 512
+
+func encodeXML(v any) ([]byte, error) {
+	if err := checkValue(v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xmlHeader)
+	writeXMLValue(&buf, v, 0)
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+func writeXMLValue(buf *bytes.Buffer, v any, depth int) {
+	indent := strings.Repeat("\t", depth)
+	buf.WriteString(indent)
+
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			buf.WriteString("<dict/>\n")
+			return
+		}
+		buf.WriteString("<dict>\n")
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			buf.WriteString(indent)
+			buf.WriteString("\t<key>")
+			xml.EscapeText(buf, []byte(k))
+			buf.WriteString("</key>\n")
+			writeXMLValue(buf, v[k], depth+1)
+		}
+		buf.WriteString(indent)
+		buf.WriteString("</dict>\n")
+	case []any:
+		if len(v) == 0 {
+			buf.WriteString("<array/>\n")
+			return
+		}
+		buf.WriteString("<array>\n")
+		for _, item := range v {
+			writeXMLValue(buf, item, depth+1)
+		}
+		buf.WriteString(indent)
+		buf.WriteString("</array>\n")
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>\n")
+	case int64:
+		fmt.Fprintf(buf, "<integer>%d</integer>\n", v)
+	case uint64:
+		fmt.Fprintf(buf, "<integer>%d</integer>\n", v)
+	case float64:
+		fmt.Fprintf(buf, "<real>%s</real>\n", formatReal(v))
+	case bool:
+		if v {
+			buf.WriteString("<true/>\n")
+		} else {
+			buf.WriteString("<false/>\n")
+		}
+	case []byte:
+		fmt.Fprintf(buf, "<data>%s</data>\n", base64.StdEncoding.EncodeToString(v))
+	case time.Time:
+		fmt.Fprintf(buf, "<date>%s</date>\n", v.UTC().Format(time.RFC3339))
+	}
+}
+
+func formatReal(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "+infinity"
+	case math.IsInf(f, -1):
+		return "-infinity"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func parseReal(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "nan":
+		return math.NaN(), nil
+	case "+infinity", "infinity", "+inf", "inf":
+		return math.Inf(1), nil
+	case "-infinity", "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+type xmlDecoder struct {
+	d *xml.Decoder
+}
+
+func decodeXML(data []byte) (any, error) {
+	dec := &xmlDecoder{d: xml.NewDecoder(bytes.NewReader(data))}
+
+	start, err := dec.nextStart()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "plist" {
+		return nil, fmt.Errorf("expected a plist element, got %s", start.Name.Local)
+	}
+
+	start, err = dec.nextStart()
+	if err != nil {
+		return nil, err
+	}
+	return dec.value(start, 0)
+}
+
+// nextStart returns the next start element, skipping the XML declaration,
+// the doctype, comments and whitespaces.
+func (dec *xmlDecoder) nextStart() (xml.StartElement, error) {
+	for {
+		tok, err := dec.d.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return xml.StartElement{}, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return tok, nil
+		case xml.EndElement:
+			return xml.StartElement{}, fmt.Errorf("unexpected end of element %s", tok.Name.Local)
+		case xml.CharData:
+			if len(bytes.TrimSpace(tok)) > 0 {
+				return xml.StartElement{}, fmt.Errorf("unexpected text %q", tok)
+			}
+		}
+	}
+}
+
+// value decodes the value whose start element was just read.
+func (dec *xmlDecoder) value(start xml.StartElement, depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("property list is nested too deeply")
+	}
+
+	switch start.Name.Local {
+	case "dict":
+		return dec.dict(depth)
+	case "array":
+		return dec.array(depth)
+	case "true", "false":
+		if err := dec.d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	text, err := dec.text()
+	if err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		return parseInteger(strings.TrimSpace(text))
+	case "real":
+		f, err := parseReal(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid real %q", text)
+		}
+		return f, nil
+	case "data":
+		b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid data: %w", err)
+		}
+		return b, nil
+	case "date":
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid date: %w", err)
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unsupported element %s", start.Name.Local)
+	}
+}
+
+func (dec *xmlDecoder) dict(depth int) (any, error) {
+	dict := map[string]any{}
+	for {
+		tok, err := dec.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			return dict, nil
+		}
+
+		start := tok.(xml.StartElement)
+		if start.Name.Local != "key" {
+			return nil, fmt.Errorf("expected a key element, got %s", start.Name.Local)
+		}
+		key, err := dec.text()
+		if err != nil {
+			return nil, err
+		}
+
+		start, err = dec.nextStart()
+		if err != nil {
+			return nil, err
+		}
+		if dict[key], err = dec.value(start, depth+1); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+}
+
+func (dec *xmlDecoder) array(depth int) (any, error) {
+	arr := []any{}
+	for {
+		tok, err := dec.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			return arr, nil
+		}
+
+		item, err := dec.value(tok.(xml.StartElement), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, item)
+	}
+}
+
+// nextToken returns the next start or end element, skipping whitespaces and
+// comments.
+func (dec *xmlDecoder) nextToken() (xml.Token, error) {
+	for {
+		tok, err := dec.d.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement, xml.EndElement:
+			return tok, nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(tok)) > 0 {
+				return nil, fmt.Errorf("unexpected text %q", tok)
+			}
+		}
+	}
+}
+
+// text returns the text content of the element just started, and consumes
+// its end element.
+func (dec *xmlDecoder) text() (string, error) {
+	var sb strings.Builder
+	for {
+		tok, err := dec.d.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			sb.Write(tok)
+		case xml.EndElement:
+			return sb.String(), nil
+		case xml.StartElement:
+			return "", fmt.Errorf("unexpected element %s", tok.Name.Local)
+		}
+	}
+}
+
+func parseInteger(s string) (any, error) {
+	digits, negative := strings.CutPrefix(s, "-")
+	digits = strings.TrimPrefix(digits, "+")
+
+	base := 10
+	if hex, ok := strings.CutPrefix(strings.ToLower(digits), "0x"); ok {
+		digits, base = hex, 16
+	}
+
+	u, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid integer %q", s)
+	}
+	return intValue(u, negative)
+}
@@ -0,0 +1,356 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// JSON hints are single-key objects used to represent XPC values that don't
+// have a JSON equivalent. See [FromJSON].
+const (
+	jsonHintInt64  = "$int64"
+	jsonHintUint64 = "$uint64"
+	jsonHintDouble = "$double"
+	jsonHintData   = "$data"
+	jsonHintDate   = "$date"
+	jsonHintUUID   = "$uuid"
+	jsonHintFD     = "$fd"
+	jsonHintDict   = "$dict"
+)
+
+// isJSONHint returns whether key is the key of a JSON hint. Single-key
+// dictionaries with such a key are wrapped in a $dict hint by [ToJSON].
+func isJSONHint(key string) bool {
+	switch key {
+	case jsonHintInt64, jsonHintUint64, jsonHintDouble, jsonHintData, jsonHintDate, jsonHintUUID, jsonHintFD, jsonHintDict:
+		return true
+	default:
+		return false
+	}
+}
+
+// minDate and maxDate are the range of dates an XPC date, which holds
+// nanoseconds since the Unix epoch as an int64, can represent.
+var (
+	minDate = time.Unix(0, math.MinInt64)
+	maxDate = time.Unix(0, math.MaxInt64)
+)
+
+// FromJSON converts a JSON document into an XPC [Object], which must be
+// released by the caller. Values are mapped as follows:
+//
+//   - objects become dictionaries, arrays become arrays, and strings, booleans
+//     and null become their XPC equivalent.
+//   - numbers without a fraction or an exponent become int64, or uint64 if
+//     they're too large for an int64. Other numbers become doubles.
+//   - {"$int64": n}, {"$uint64": n} and {"$double": n} force the type of n,
+//     which can be a number or a string.
+//   - {"$data": "base64"} becomes data, decoded from standard base64.
+//   - {"$date": "2006-01-02T15:04:05Z"} becomes a date, parsed as RFC 3339.
+//   - {"$uuid": "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX"} becomes a UUID.
+//   - {"$dict": {...}} becomes a dictionary holding the entries of the inner
+//     object, which is never read as a hint itself. This escapes single-key
+//     objects whose key is a hint, like {"$dict": {"$date": "..."}}.
+//
+// A single-key object is a hint only if its key is one of the above. Dates
+// must be between the years 1678 and 2262, as XPC stores them as nanoseconds
+// since the Unix epoch. File descriptors can't be represented in JSON, and
+// {"$fd": ...} is rejected.
+// [ToJSON] does the opposite conversion.
+func FromJSON(data []byte) (Object, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return Object{}, err
+	}
+	if dec.More() {
+		return Object{}, errors.New("unexpected data after the JSON document")
+	}
+	obj, err := fromJSONValue(v)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ptr: unsafe.Pointer(obj)}, nil
+}
+
+func fromJSONValue(v any) (C.xpc_object_t, error) {
+	switch v := v.(type) {
+	case nil:
+		return C.xpc_null_create(), nil
+	case bool:
+		return C.xpc_bool_create(C.bool(v)), nil
+	case string:
+		cs := C.CString(v)
+		defer C.free(unsafe.Pointer(cs))
+		return C.xpc_string_create(cs), nil
+	case json.Number:
+		return fromJSONNumber(v.String())
+	case []any:
+		arr := C.xpc_array_create_empty()
+		for _, item := range v {
+			obj, err := fromJSONValue(item)
+			if err != nil {
+				C.xpc_release(arr)
+				return nil, err
+			}
+			C.xpc_array_append_value(arr, obj)
+			C.xpc_release(obj)
+		}
+		return arr, nil
+	case map[string]any:
+		if len(v) == 1 {
+			for hint, value := range v {
+				if obj, ok, err := fromJSONHint(hint, value); ok {
+					return obj, err
+				}
+			}
+		}
+		return fromJSONObject(v)
+	default:
+		return nil, fmt.Errorf("unsupported JSON value %T", v)
+	}
+}
+
+// fromJSONObject converts v into a dictionary, without checking whether it's
+// a hint.
+func fromJSONObject(v map[string]any) (C.xpc_object_t, error) {
+	dict := C.xpc_dictionary_create_empty()
+	for key, item := range v {
+		obj, err := fromJSONValue(item)
+		if err != nil {
+			C.xpc_release(dict)
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		ckey := C.CString(key)
+		C.xpc_dictionary_set_value(dict, ckey, obj)
+		C.free(unsafe.Pointer(ckey))
+		C.xpc_release(obj)
+	}
+	return dict, nil
+}
+
+func fromJSONNumber(s string) (C.xpc_object_t, error) {
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return C.xpc_int64_create(C.int64_t(i)), nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return C.xpc_uint64_create(C.uint64_t(u)), nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s: %w", s, err)
+	}
+	return C.xpc_double_create(C.double(f)), nil
+}
+
+// fromJSONHint converts the value of a hint object. ok is false if hint isn't
+// a known hint, in which case the object is a regular dictionary.
+func fromJSONHint(hint string, value any) (_ C.xpc_object_t, ok bool, _ error) {
+	// Numbers can be written as strings, such that tools that parse JSON
+	// numbers as doubles don't lose precision.
+	str, isString := value.(string)
+	num := str
+	if n, ok := value.(json.Number); ok {
+		num = n.String()
+	}
+
+	switch hint {
+	case jsonHintInt64:
+		i, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid %s value %v", hint, value)
+		}
+		return C.xpc_int64_create(C.int64_t(i)), true, nil
+	case jsonHintUint64:
+		u, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid %s value %v", hint, value)
+		}
+		return C.xpc_uint64_create(C.uint64_t(u)), true, nil
+	case jsonHintDouble:
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid %s value %v", hint, value)
+		}
+		return C.xpc_double_create(C.double(f)), true, nil
+	case jsonHintData:
+		if !isString {
+			return nil, true, fmt.Errorf("%s value must be a string", hint)
+		}
+		b, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid %s value: %w", hint, err)
+		}
+		if len(b) == 0 {
+			return C.xpc_data_create(nil, 0), true, nil
+		}
+		return C.xpc_data_create(unsafe.Pointer(&b[0]), C.size_t(len(b))), true, nil
+	case jsonHintDate:
+		if !isString {
+			return nil, true, fmt.Errorf("%s value must be a string", hint)
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid %s value: %w", hint, err)
+		}
+		if t.Before(minDate) || t.After(maxDate) {
+			return nil, true, fmt.Errorf("invalid %s value: %s is out of range", hint, str)
+		}
+		return C.xpc_date_create(C.int64_t(t.UnixNano())), true, nil
+	case jsonHintUUID:
+		if !isString {
+			return nil, true, fmt.Errorf("%s value must be a string", hint)
+		}
+		b, err := hex.DecodeString(strings.ReplaceAll(str, "-", ""))
+		if err != nil || len(b) != 16 {
+			return nil, true, fmt.Errorf("invalid %s value %v", hint, value)
+		}
+		return C.xpc_uuid_create((*C.uchar)(unsafe.Pointer(&b[0]))), true, nil
+	case jsonHintFD:
+		return nil, true, errors.New("file descriptors can't be converted from JSON")
+	case jsonHintDict:
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil, true, fmt.Errorf("%s value must be an object", hint)
+		}
+		obj, err := fromJSONObject(m)
+		return obj, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// ToJSON converts an XPC object into JSON, following the mapping described by
+// [FromJSON]: int64 are written as numbers, doubles are written as numbers
+// with a fraction or an exponent, and other values without a JSON equivalent
+// are written as hints. uint64 hints hold strings. Dictionary keys are sorted,
+// and single-key dictionaries whose key is a hint are wrapped in a $dict hint.
+// It returns an error if obj holds a file descriptor, or any other type that
+// can't be represented.
+//
+// Like [Describe], v is either an unsafe.Pointer to an XPC object, or a Go
+// value which is passed through [Marshal] first.
+func ToJSON(v any) ([]byte, error) {
+	obj, release, err := toXPCObject(v)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var buf bytes.Buffer
+	if err := toJSONValue(&buf, obj); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSONValue(buf *bytes.Buffer, obj C.xpc_object_t) error {
+	if obj == nil {
+		buf.WriteString("null")
+		return nil
+	}
+
+	switch C.xpc_get_type(obj) {
+	case C.XPC_TYPE_NULL:
+		buf.WriteString("null")
+	case C.XPC_TYPE_BOOL:
+		buf.WriteString(strconv.FormatBool(bool(C.xpc_bool_get_value(obj))))
+	case C.XPC_TYPE_INT64:
+		buf.WriteString(strconv.FormatInt(int64(C.xpc_int64_get_value(obj)), 10))
+	case C.XPC_TYPE_UINT64:
+		writeJSONHint(buf, jsonHintUint64, strconv.FormatUint(uint64(C.xpc_uint64_get_value(obj)), 10))
+	case C.XPC_TYPE_DOUBLE:
+		f := float64(C.xpc_double_get_value(obj))
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("unsupported double value %v", f)
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			// Otherwise, it would be read back as an int64.
+			s += ".0"
+		}
+		buf.WriteString(s)
+	case C.XPC_TYPE_STRING:
+		writeJSONString(buf, C.GoString(C.xpc_string_get_string_ptr(obj)))
+	case C.XPC_TYPE_DATA:
+		b := C.GoBytes(C.xpc_data_get_bytes_ptr(obj), C.int(C.xpc_data_get_length(obj)))
+		writeJSONHint(buf, jsonHintData, base64.StdEncoding.EncodeToString(b))
+	case C.XPC_TYPE_DATE:
+		t := time.Unix(0, int64(C.xpc_date_get_value(obj))).UTC()
+		writeJSONHint(buf, jsonHintDate, t.Format(time.RFC3339Nano))
+	case C.XPC_TYPE_UUID:
+		writeJSONHint(buf, jsonHintUUID, formatUUID(C.GoBytes(unsafe.Pointer(C.xpc_uuid_get_bytes(obj)), 16)))
+	case C.XPC_TYPE_ARRAY:
+		buf.WriteByte('[')
+		for i := 0; i < int(C.xpc_array_get_count(obj)); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := toJSONValue(buf, C.xpc_array_get_value(obj, C.size_t(i))); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case C.XPC_TYPE_DICTIONARY:
+		keys := dictKeys(obj)
+		escape := len(keys) == 1 && isJSONHint(keys[0])
+		if escape {
+			buf.WriteByte('{')
+			writeJSONString(buf, jsonHintDict)
+			buf.WriteByte(':')
+		}
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, key)
+			buf.WriteByte(':')
+			if err := toJSONValue(buf, dictValue(obj, key)); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		buf.WriteByte('}')
+		if escape {
+			buf.WriteByte('}')
+		}
+	case C.XPC_TYPE_FD:
+		return errors.New("file descriptors can't be converted to JSON")
+	default:
+		return fmt.Errorf("unsupported XPC type %s", typeName(obj))
+	}
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	// Marshaling a string never fails.
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+func writeJSONHint(buf *bytes.Buffer, hint, value string) {
+	buf.WriteByte('{')
+	writeJSONString(buf, hint)
+	buf.WriteByte(':')
+	writeJSONString(buf, value)
+	buf.WriteByte('}')
+}
@@ -0,0 +1,112 @@
+package xpc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	doc := `{"a":1,"b":1.5,"c":{"$uint64":"18446744073709551615"},"d":{"$data":"AQI="},` +
+		`"e":{"$date":"2024-01-02T03:04:05.5Z"},"f":{"$uuid":"0F8FAD5B-D9CB-469F-A165-70867728950E"},` +
+		`"g":[true,null,"x"],"h":2.0,"i":{"$int64":"-3"},"j":{}}`
+
+	obj, err := FromJSON([]byte(doc))
+	require.NoError(t, err)
+	defer obj.Release()
+
+	out, err := ToJSON(obj)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1,"b":1.5,"c":{"$uint64":"18446744073709551615"},"d":{"$data":"AQI="},`+
+		`"e":{"$date":"2024-01-02T03:04:05.5Z"},"f":{"$uuid":"0F8FAD5B-D9CB-469F-A165-70867728950E"},`+
+		`"g":[true,null,"x"],"h":2.0,"i":-3,"j":{}}`, string(out))
+}
+
+func TestJSONDictHint(t *testing.T) {
+	// Single-key dictionaries whose key is a hint are escaped.
+	for _, doc := range []string{
+		`{"$dict":{"$date":"not a date"}}`,
+		`{"$dict":{"$dict":{"a":1}}}`,
+		`{"a":{"$dict":{"$fd":{"$int64":"1"}}}}`,
+	} {
+		obj, err := FromJSON([]byte(doc))
+		require.NoError(t, err, doc)
+		out, err := ToJSON(obj)
+		obj.Release()
+		require.NoError(t, err, doc)
+		assert.Equal(t, doc, string(out))
+	}
+
+	// Other dictionaries don't need to be.
+	obj, err := FromJSON([]byte(`{"$dict":{"a":1,"$date":"x"}}`))
+	require.NoError(t, err)
+	defer obj.Release()
+	out, err := ToJSON(obj)
+	require.NoError(t, err)
+	assert.Equal(t, `{"$date":"x","a":1}`, string(out))
+}
+
+func TestFromJSONNumbers(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{json: `1`, want: "int64"},
+		{json: `-1`, want: "int64"},
+		{json: `18446744073709551615`, want: "uint64"},
+		{json: `1.0`, want: "double"},
+		{json: `1e3`, want: "double"},
+		{json: `{"$double":1}`, want: "double"},
+		{json: `{"$uint64":1}`, want: "uint64"},
+		{json: `{"$int64":"1"}`, want: "int64"},
+		{json: `{"$other":1}`, want: "dictionary"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.json, func(t *testing.T) {
+			obj, err := FromJSON([]byte(tc.json))
+			require.NoError(t, err)
+			defer obj.Release()
+			assert.Equal(t, tc.want, getXPCType(obj))
+		})
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"a":`,
+		`{} {}`,
+		`{"$fd":3}`,
+		`{"$data":1}`,
+		`{"$data":"not base64"}`,
+		`{"$date":"yesterday"}`,
+		`{"$date":"1677-01-01T00:00:00Z"}`,
+		`{"$date":"2263-01-01T00:00:00Z"}`,
+		`{"$dict":[]}`,
+		`{"$uuid":"1234"}`,
+		`{"$uint64":-1}`,
+		`{"nested":[{"$int64":1.5}]}`,
+	} {
+		_, err := FromJSON([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	out, err := ToJSON(struct {
+		Name  string   `xpc:"name"`
+		Count uint32   `xpc:"count"`
+		Tags  []string `xpc:"tags"`
+	}{Name: "John Doe", Count: 3, Tags: []string{"a"}})
+	require.NoError(t, err)
+	assert.Equal(t, `{"count":{"$uint64":"3"},"name":"John Doe","tags":["a"]}`, string(out))
+
+	f, err := os.CreateTemp(t.TempDir(), "xpc-json-fd")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = ToJSON(struct{ File FD }{File: FD(f.Fd())})
+	assert.ErrorContains(t, err, "file descriptors can't be converted to JSON")
+}
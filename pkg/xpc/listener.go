@@ -7,18 +7,57 @@ package xpc
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"runtime/cgo"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
 	"unsafe"
 )
 
 type listener struct {
-	l        unsafe.Pointer
-	q        unsafe.Pointer
-	ch       chan Message
-	chHandle cgo.Handle
-	cb       Handler
+	name    string
+	l       unsafe.Pointer
+	q       unsafe.Pointer
+	ch      chan Message
+	handle  cgo.Handle
+	cb      ContextHandler
+	onPanic PanicHandler
+	timeout time.Duration
+	tracer  Tracer
+	metrics Metrics
+	limiter *rateLimiter
+	audit   *AuditOptions
+	sched   *scheduler[unsafe.Pointer, event]
+
+	onConnect    func(peer *Session) (any, error)
+	onDisconnect func(peer *Session, state any)
+
+	rejectWhenBusy bool
+	// rejects bounds the number of messages being rejected concurrently.
+	rejects chan struct{}
+	// running tracks the run loop, and the rejects it hands off to other
+	// goroutines.
+	running sync.WaitGroup
+
+	// ctx is the parent context of all handlers. It's cancelled when the
+	// listener is shut down and in-flight handlers didn't finish in time.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed when the listener stops accepting messages.
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	peers map[unsafe.Pointer]*peerConn
+	// peersWG tracks connected peers, such that resources are released only
+	// once all of them are disconnected.
+	peersWG     sync.WaitGroup
+	releaseOnce sync.Once
 }
 
 type Message struct {
@@ -31,79 +70,566 @@ func (m Message) Release() {
 	C.xpc_release((C.xpc_object_t)(m.Peer))
 }
 
-func newListener(name, requirement string, cb Handler) (listener, error) {
-	cname := C.CString(name)
+// event is processed by the listener's workers. It's either a message to
+// handle, or the disconnection of a peer. Both go through the same queue so
+// that a peer is disconnected only after its pending messages are handled.
+type event struct {
+	msg          Message
+	disconnected *peerConn
+}
+
+func newListener(cfg Listener, opts ServerOptions) (*listener, error) {
+	cname := C.CString(cfg.Name)
 	defer C.free(unsafe.Pointer(cname))
 
 	var crequirement *C.char
-	if requirement != "" {
-		crequirement = C.CString(requirement)
+	if cfg.Requirement != "" {
+		crequirement = C.CString(cfg.Requirement)
 		defer C.free(unsafe.Pointer(crequirement))
 	}
 
-	ch := make(chan Message)
-	chHandle := cgo.NewHandle(ch)
+	handler := cfg.ContextHandler
+	if cfg.Handler != nil {
+		if handler != nil {
+			return nil, fmt.Errorf("listener %s: Handler and ContextHandler can't both be set", cfg.Name)
+		}
+		handler = cfg.Handler.withContext()
+	}
+
+	middlewares := append(slices.Clip(opts.Middlewares), cfg.Middlewares...)
+	if len(cfg.Policies) > 0 {
+		mw, err := enforcePolicies(cfg.Policies, opts.OnPolicyDenied)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+		}
+		middlewares = append(middlewares, mw)
+	}
+
+	if opts.Audit != nil {
+		if err := opts.Audit.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var limiter *rateLimiter
+	if cfg.RateLimit != nil {
+		var err error
+		if limiter, err = newRateLimiter(*cfg.RateLimit); err != nil {
+			return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &listener{
+		name:           cfg.Name,
+		ch:             make(chan Message),
+		cb:             chain(handler, middlewares...),
+		onPanic:        opts.PanicHandler,
+		timeout:        cfg.Timeout,
+		tracer:         opts.Tracer,
+		metrics:        opts.Metrics,
+		limiter:        limiter,
+		audit:          opts.Audit,
+		rejectWhenBusy: cfg.RejectWhenBusy,
+		rejects:        make(chan struct{}, maxConcurrentRejects),
+		ctx:            ctx,
+		cancel:         cancel,
+		done:           make(chan struct{}),
+		peers:          map[unsafe.Pointer]*peerConn{},
+		onConnect:      cfg.OnConnect,
+		onDisconnect:   cfg.OnDisconnect,
+	}
+	if l.onPanic == nil {
+		l.onPanic = logPanic
+	}
+	if l.metrics == nil {
+		l.metrics = NopMetrics{}
+	}
+	l.handle = cgo.NewHandle(l)
 
-	res := C.new_listener(cname, crequirement, C.uintptr_t(chHandle))
+	res := C.new_listener(cname, crequirement, C.uintptr_t(l.handle))
 	switch res.err_code {
 	case 0:
 		// No errors
 	case C.XPC_LISTENER_CREATE_FAILED:
-		chHandle.Delete()
+		l.handle.Delete()
 		defer C.xpc_release((C.xpc_object_t)(res.err))
-		return listener{}, newRichError(unsafe.Pointer(res.err))
+		return nil, newRichError(unsafe.Pointer(res.err))
 	case C.XPC_LISTENER_SET_PEER_CODE_SIGNING_REQUIREMENT_FAILED:
-		chHandle.Delete()
-		return listener{}, errors.New("failed to set code signing requirement")
+		l.handle.Delete()
+		defer C.xpc_release((C.xpc_object_t)(res.err))
+		return nil, fmt.Errorf("failed to set code signing requirement: %w", newRichError(unsafe.Pointer(res.err)))
 	case C.XPC_LISTENER_ACTIVATE_FAILED:
-		chHandle.Delete()
+		l.handle.Delete()
 		defer C.xpc_release((C.xpc_object_t)(res.err))
-		return listener{}, fmt.Errorf("failed to activate listener: %w", newRichError(unsafe.Pointer(res.err)))
+		return nil, fmt.Errorf("failed to activate listener: %w", newRichError(unsafe.Pointer(res.err)))
 	default:
-		chHandle.Delete()
-		return listener{}, fmt.Errorf("unknown error code: %d", res.err_code)
+		l.handle.Delete()
+		return nil, fmt.Errorf("unknown error code: %d", res.err_code)
 	}
 
-	return listener{
-		l:        unsafe.Pointer(res.listener),
-		q:        unsafe.Pointer(res.queue),
-		ch:       ch,
-		chHandle: chHandle,
-		cb:       cb,
-	}, nil
+	l.l = unsafe.Pointer(res.listener)
+	l.q = unsafe.Pointer(res.queue)
+	// Messages are keyed by peer, so that messages sent by a same peer are
+	// handled in order.
+	l.sched = newScheduler[unsafe.Pointer](cfg.MaxConcurrency, cfg.MaxQueue, l.handleEvent)
+
+	return l, nil
 }
 
+// run passes the messages received to the scheduler, until the listener is
+// stopped. l.running must have been incremented for it.
 func (l *listener) run() {
-	for msg := range l.ch {
-		sess := Session{sess: unsafe.Pointer(msg.Peer)}
-		l.cb(&sess, msg.Msg)
+	defer l.running.Done()
+	for {
+		select {
+		case msg := <-l.ch:
+			l.metrics.MessageReceived(l.name)
+			if l.limiter != nil && !l.limiter.allow(peerInfoFromMessage(msg.Msg), time.Now()) {
+				l.metrics.RateLimited(l.name)
+				l.rejectAsync(msg, &RemoteError{
+					Code:      CodeRateLimited,
+					Message:   "too many requests",
+					Retryable: true,
+				})
+				continue
+			}
+			if err := l.sched.push(msg.Peer, event{msg: msg}, !l.rejectWhenBusy); err != nil {
+				if errors.Is(err, errQueueFull) {
+					l.rejectAsync(msg, &RemoteError{
+						Code:      CodeBusy,
+						Message:   "server is busy",
+						Retryable: true,
+					})
+				} else {
+					msg.Release()
+				}
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// maxConcurrentRejects is the maximum number of messages a listener rejects
+// concurrently. Past that, messages are dropped without a reply nor an audit
+// record.
+const maxConcurrentRejects = 64
+
+// rejectAsync rejects msg in a new goroutine, such that sending the reply and
+// writing the audit record don't hold up the run loop. If too many messages
+// are being rejected already, msg is dropped without a reply, and isn't
+// audited, since writing the record would hold up the run loop too.
+func (l *listener) rejectAsync(msg Message, remoteErr *RemoteError) {
+	select {
+	case l.rejects <- struct{}{}:
+	default:
 		msg.Release()
+		return
 	}
+
+	l.running.Add(1)
+	go func() {
+		defer l.running.Done()
+		defer func() { <-l.rejects }()
+		l.reject(msg, remoteErr)
+	}()
 }
 
+// reject replies remoteErr to msg without handling it, and releases msg.
+// Like with any error reply, nothing is sent for one-way messages.
+func (l *listener) reject(msg Message, remoteErr *RemoteError) {
+	defer msg.Release()
+
+	sess := &Session{sess: msg.Peer}
+	if l.audit != nil {
+		sess.req = l.newRequestInfo(msg)
+		defer l.auditRequest(l.lookupPeer(msg.Peer), sess.req)
+	}
+	ReplyError(sess, msg.Msg, remoteErr)
+}
+
+func (l *listener) handleEvent(ev event) {
+	if ev.disconnected != nil {
+		l.disconnect(ev.disconnected)
+		return
+	}
+	l.handleMsg(ev.msg)
+}
+
+// handleMsg calls the handler for msg. If the handler panics, the panic is
+// recovered so that other peers can still be served, and an internal error
+// reply is sent back to the client.
+//
+// If msg is the first message sent by its peer, the OnConnect hook is
+// called first.
+//
+// The handler runs in its own goroutine, such that the client gets a timeout
+// error reply as soon as the handler's deadline is exceeded. The worker still
+// waits for the handler to return before moving on to the next message, such
+// that messages sent by a same peer are handled in order, and MaxConcurrency
+// bounds the number of running handlers.
+func (l *listener) handleMsg(msg Message) {
+	defer msg.Release()
+
+	p := l.lookupPeer(msg.Peer)
+	p.mu.Lock()
+	connected, rejected := p.connected, p.rejected
+	p.mu.Unlock()
+	if rejected {
+		if l.audit != nil {
+			l.auditRejected(p, l.newRequestInfo(msg))
+		}
+		return
+	}
+
+	info := l.newRequestInfo(msg)
+	sess := &Session{
+		sess: unsafe.Pointer(msg.Peer),
+		peer: p,
+		req:  info,
+	}
+
+	if !connected {
+		if err := l.connect(p, info.Peer); err != nil {
+			ReplyError(sess, msg.Msg, Errorf(CodePermissionDenied, "%v", err))
+			C.xpc_session_cancel((C.xpc_session_t)(msg.Peer))
+			l.auditRequest(p, info)
+			return
+		}
+	}
+
+	ctx, cancel := l.handlerContext(info, msg.Msg)
+	defer cancel()
+
+	endSpan := func(ErrorCode) {}
+	if l.tracer != nil {
+		carrier := getStringDict[TraceCarrier]((C.xpc_object_t)(msg.Msg), traceContextKey)
+		if carrier == nil {
+			carrier = TraceCarrier{}
+		}
+		ctx, endSpan = l.tracer.Start(ctx, carrier, info)
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.callHandler(ctx, sess, msg.Msg)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			ReplyError(sess, msg.Msg, Errorf(CodeDeadlineExceeded, "handler timed out"))
+		}
+		<-done
+	}
+
+	l.metrics.HandlerDone(l.name, info.Method, time.Since(start), info.ErrorCode())
+	endSpan(info.ErrorCode())
+	l.auditRequest(p, info)
+}
+
+func (l *listener) newRequestInfo(msg Message) *RequestInfo {
+	return &RequestInfo{
+		Service:  l.name,
+		Method:   messageMethod(msg.Msg),
+		Peer:     peerInfoFromMessage(msg.Msg),
+		Received: time.Now(),
+		Metadata: messageMetadata(msg.Msg),
+		metrics:  l.metrics,
+	}
+}
+
+// auditRequest records the request sent by p, and described by info, in the
+// audit log, if the server has one.
+func (l *listener) auditRequest(p *peerConn, info *RequestInfo) {
+	if l.audit == nil {
+		return
+	}
+
+	// Unsigned peers, or peers that exited already, are still audited.
+	l.audit.write(newAuditRecord(info, p.signingIdentifier(info.Peer), time.Now()))
+}
+
+// auditRejected records the request sent by p, and dropped because p was
+// rejected, in the audit log.
+func (l *listener) auditRejected(p *peerConn, info *RequestInfo) {
+	rec := newAuditRecord(info, p.signingIdentifier(info.Peer), time.Now())
+	rec.Outcome = AuditOutcomeRejected
+	l.audit.write(rec)
+}
+
+// handlerContext returns the context passed to the handler of msg. Its
+// deadline is the earliest of the listener's Timeout, and the deadline set by
+// the client.
+func (l *listener) handlerContext(info *RequestInfo, msg unsafe.Pointer) (context.Context, context.CancelFunc) {
+	ctx := withRequestInfo(l.ctx, info)
+
+	var deadline time.Time
+	if l.timeout > 0 {
+		deadline = info.Received.Add(l.timeout)
+	}
+	if d, ok := messageDeadline(msg); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// callHandler calls the listener's handler, and recovers from its panics.
+func (l *listener) callHandler(ctx context.Context, sess *Session, msg unsafe.Pointer) {
+	defer func() {
+		if p := recover(); p != nil {
+			l.metrics.Panic(l.name)
+			l.onPanic(ctx, PanicInfo{
+				Service: l.name,
+				Session: sess,
+				Value:   p,
+				Stack:   debug.Stack(),
+			})
+			if !sess.req.Replied() {
+				ReplyError(sess, msg, Errorf(CodeInternal, "internal error"))
+			}
+		}
+	}()
+
+	l.cb(ctx, sess, msg)
+}
+
+// lookupPeer returns the peerConn for the XPC session peer.
+func (l *listener) lookupPeer(peer unsafe.Pointer) *peerConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if p, ok := l.peers[peer]; ok {
+		return p
+	}
+	// This shouldn't happen since on_peer_connect is called before any
+	// message is received, but better be safe than sorry.
+	return newPeerConn(peer)
+}
+
+// connect calls the OnConnect hook for p, and stores the state it returns.
+// It's called from the workers, so it can't race with the handling of the
+// messages sent by p.
+func (l *listener) connect(p *peerConn, info PeerInfo) error {
+	p.mu.Lock()
+	p.info = info
+	p.mu.Unlock()
+
+	var state any
+	if l.onConnect != nil {
+		var err error
+		if state, err = l.onConnect(p.session); err != nil {
+			p.mu.Lock()
+			p.rejected = true
+			p.mu.Unlock()
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.connected = true
+	p.state = state
+	p.mu.Unlock()
+	return nil
+}
+
+// disconnect calls the OnDisconnect hook for p if it was connected, and
+// releases it.
+func (l *listener) disconnect(p *peerConn) {
+	defer l.peersWG.Done()
+
+	// Sessions kept by handlers might still try to send messages to the
+	// peer, so mark it as disconnected before releasing it.
+	p.mu.Lock()
+	p.disconnected = true
+	connected, state := p.connected, p.state
+	C.xpc_release((C.xpc_object_t)(p.session.sess))
+	p.mu.Unlock()
+
+	if !connected || l.onDisconnect == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			l.onPanic(l.ctx, PanicInfo{
+				Service: l.name,
+				Session: p.session,
+				Value:   r,
+				Stack:   debug.Stack(),
+			})
+		}
+	}()
+	l.onDisconnect(p.session, state)
+}
+
+// connectedPeers returns the sessions of all the peers accepted by the
+// OnConnect hook.
+func (l *listener) connectedPeers() []*Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(l.peers))
+	for _, p := range l.peers {
+		p.mu.Lock()
+		if p.connected && !p.disconnected {
+			sessions = append(sessions, p.session)
+		}
+		p.mu.Unlock()
+	}
+	return sessions
+}
+
+func logPanic(_ context.Context, info PanicInfo) {
+	log.Printf("xpc: panic serving %s: %v\n%s", info.Service, info.Value, info.Stack)
+}
+
+// shutdown stops accepting new peers and messages, and waits for in-flight
+// handlers to finish. If ctx is done before that, the handlers' context is
+// cancelled and ctx's error is returned. Resources are released once all the
+// handlers have returned.
+func (l *listener) shutdown(ctx context.Context) error {
+	l.stop()
+
+	drained := make(chan struct{})
+	go func() {
+		l.drain()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		l.cancel()
+		l.release()
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		go func() {
+			<-drained
+			l.release()
+		}()
+		return ctx.Err()
+	}
+}
+
+// stop stops accepting new peers and messages.
+func (l *listener) stop() {
+	l.stopOnce.Do(func() {
+		C.xpc_listener_cancel((C.xpc_listener_t)(l.l))
+		close(l.done)
+	})
+}
+
+// drain waits for the run loop to stop, for the messages already received to
+// be handled or rejected, and for all the handlers to return.
+func (l *listener) drain() {
+	l.running.Wait()
+	l.sched.close()
+}
+
+// release disconnects all the peers, and frees the resources held by the
+// listener. It must be called once the listener is stopped and no handlers
+// are running anymore.
+func (l *listener) release() {
+	l.releaseOnce.Do(func() {
+		// Wait for peers currently being set up, then disconnect all of
+		// them. Their cancel handlers will run on the listener's queue, so
+		// wait for them too before deleting the handle they use.
+		C.drain_queue((C.dispatch_queue_t)(l.q))
+
+		l.mu.Lock()
+		for peer := range l.peers {
+			C.xpc_session_cancel((C.xpc_session_t)(peer))
+		}
+		l.mu.Unlock()
+
+		l.peersWG.Wait()
+		C.drain_queue((C.dispatch_queue_t)(l.q))
+
+		// According to [1], xpc_release must be called when it's no longer needed.
+		//
+		// [1]: https://developer.apple.com/documentation/xpc/xpc_listener_create?language=objc
+		C.xpc_release((C.xpc_object_t)(l.l))
+		if l.q != nil {
+			C.dispatch_release((C.dispatch_queue_t)(l.q))
+		}
+		l.handle.Delete()
+	})
+}
+
+// Close stops the listener and cancels the context of its handlers right
+// away. Unlike shutdown, it then waits for them to return, and releases the
+// listener's resources before returning.
 func (l *listener) Close() error {
-	C.xpc_listener_cancel((C.xpc_listener_t)(l.l))
-	// According to [1], xpc_release must be called when it's no longer needed.
-	//
-	// [1]: https://developer.apple.com/documentation/xpc/xpc_listener_create?language=objc
-	C.xpc_release((C.xpc_object_t)(l.l))
-	if l.q != nil {
-		C.dispatch_release((C.dispatch_queue_t)(l.q))
-	}
-	l.chHandle.Delete()
-	close(l.ch)
+	l.stop()
+	l.cancel()
+	l.drain()
+	l.release()
 	return nil
 }
 
+// deliver passes msg to the listener's run loop, or drops it if the listener
+// is stopped.
+func (l *listener) deliver(msg Message) {
+	select {
+	case l.ch <- msg:
+	case <-l.done:
+		msg.Release()
+	}
+}
+
 //export on_msg_recv
 func on_msg_recv(h C.uintptr_t, peer C.xpc_session_t, msg C.xpc_object_t) {
-	ch := cgo.Handle(h).Value().(chan Message)
+	l := cgo.Handle(h).Value().(*listener)
 
 	C.xpc_retain(msg)
 	C.xpc_retain(peer)
 
-	ch <- Message{
+	l.deliver(Message{
 		Peer: unsafe.Pointer(peer),
 		Msg:  unsafe.Pointer(msg),
+	})
+}
+
+//export on_peer_connect
+func on_peer_connect(h C.uintptr_t, peer C.xpc_session_t) {
+	l := cgo.Handle(h).Value().(*listener)
+
+	C.xpc_retain(peer)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peers[unsafe.Pointer(peer)] = newPeerConn(unsafe.Pointer(peer))
+	l.peersWG.Add(1)
+	l.metrics.ActivePeers(l.name, len(l.peers))
+}
+
+//export on_peer_disconnect
+func on_peer_disconnect(h C.uintptr_t, peer C.xpc_session_t) {
+	l := cgo.Handle(h).Value().(*listener)
+
+	l.mu.Lock()
+	p, ok := l.peers[unsafe.Pointer(peer)]
+	delete(l.peers, unsafe.Pointer(peer))
+	if ok {
+		l.metrics.ActivePeers(l.name, len(l.peers))
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if err := l.sched.push(unsafe.Pointer(peer), event{disconnected: p}, true); err != nil {
+		// The listener is shut down and no handlers are running anymore, so
+		// it's safe to disconnect the peer right away.
+		l.disconnect(p)
 	}
 }
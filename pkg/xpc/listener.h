@@ -1,4 +1,5 @@
 #import <xpc/xpc.h>
+#import "queue.h"
 
 #define XPC_LISTENER_CREATE_FAILED -1
 #define XPC_LISTENER_SET_PEER_CODE_SIGNING_REQUIREMENT_FAILED -2
@@ -14,3 +15,5 @@ typedef struct new_listener_res_t {
 new_listener_res_t new_listener(const char *service, const char *requirement, uintptr_t opaque);
 
 extern void on_msg_recv(uintptr_t opaque, xpc_session_t peer, xpc_object_t msg);
+extern void on_peer_connect(uintptr_t opaque, xpc_session_t peer);
+extern void on_peer_disconnect(uintptr_t opaque, xpc_session_t peer);
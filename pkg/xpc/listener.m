@@ -12,9 +12,14 @@ new_listener_res_t new_listener(const char *service, const char *requirement, ui
 		// requirements.
 		XPC_LISTENER_CREATE_INACTIVE,
 		^(xpc_session_t _Nonnull peer) {
+			on_peer_connect(opaque, peer);
+
 			xpc_session_set_incoming_message_handler(peer, ^(xpc_object_t _Nonnull message) {
 				on_msg_recv(opaque, peer, message);
 			});
+			xpc_session_set_cancel_handler(peer, ^(xpc_rich_error_t _Nonnull error) {
+				on_peer_disconnect(opaque, peer);
+			});
 		},
 		&error);
 
@@ -27,12 +32,14 @@ new_listener_res_t new_listener(const char *service, const char *requirement, ui
 	}
 
 	if (requirement != NULL) {
-		if (xpc_listener_set_peer_code_signing_requirement(listener, requirement)) {
+		error = xpc_listener_set_peer_code_signing_requirement(listener, requirement);
+		if (error != NULL) {
 			xpc_listener_cancel(listener);
 			xpc_release((xpc_object_t)listener);
 			dispatch_release(queue);
 
 			return (new_listener_res_t){
+				.err = error,
 				.err_code = XPC_LISTENER_SET_PEER_CODE_SIGNING_REQUIREMENT_FAILED,
 			};
 		}
@@ -0,0 +1,67 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"context"
+	"unsafe"
+)
+
+// Metadata holds key-value pairs sent along with a message, like request IDs
+// or the client's version, without adding them to every message struct.
+// Clients set it with [WithMetadata] or [SendWithMetadata], and handlers read
+// it with [MetadataFromContext].
+type Metadata map[string]string
+
+// metadataKey is the reserved key under which [Metadata] is sent, as an XPC
+// dictionary of strings.
+const metadataKey = "_meta"
+
+// Get returns the value associated with key, or an empty string.
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+// WithMetadata returns a [CallOption] that sends md along with the message.
+// It can be passed multiple times, in which case later values take
+// precedence.
+func WithMetadata(md Metadata) CallOption {
+	return func(o *callOptions) {
+		if o.metadata == nil {
+			o.metadata = Metadata{}
+		}
+		for k, v := range md {
+			o.metadata[k] = v
+		}
+	}
+}
+
+// SendWithMetadata is like [Send], but also sends md. It's a shorthand for
+// passing [WithMetadata] to [Send].
+func SendWithMetadata[In any](s *Session, msg In, md Metadata) error {
+	return Send(s, msg, WithMetadata(md))
+}
+
+// MetadataFromContext returns the [Metadata] sent by the client along with the
+// message being handled, or nil if there's none.
+func MetadataFromContext(ctx context.Context) Metadata {
+	info := RequestInfoFromContext(ctx)
+	if info == nil {
+		return nil
+	}
+	return info.Metadata
+}
+
+// setMetadata stores md into payload. It does nothing if md is empty.
+func setMetadata(payload C.xpc_object_t, md Metadata) {
+	setStringDict(payload, metadataKey, md)
+}
+
+// messageMetadata returns the [Metadata] sent along with msg. Values that
+// aren't strings are ignored.
+func messageMetadata(msg unsafe.Pointer) Metadata {
+	return getStringDict((C.xpc_object_t)(msg), metadataKey)
+}
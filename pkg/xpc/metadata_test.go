@@ -0,0 +1,29 @@
+package xpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMetadata(t *testing.T) {
+	o := newCallOptions(nil)
+	assert.Nil(t, o.metadata)
+
+	o = newCallOptions([]CallOption{
+		WithMetadata(Metadata{"request_id": "1", "locale": "en_US"}),
+		WithMetadata(Metadata{"locale": "fr_FR"}),
+	})
+	assert.Equal(t, Metadata{"request_id": "1", "locale": "fr_FR"}, o.metadata)
+}
+
+func TestMetadataFromContext(t *testing.T) {
+	assert.Nil(t, MetadataFromContext(context.Background()))
+
+	md := Metadata{"client_version": "1.2.3"}
+	ctx := withRequestInfo(context.Background(), &RequestInfo{Metadata: md})
+	assert.Equal(t, md, MetadataFromContext(ctx))
+	assert.Equal(t, "1.2.3", MetadataFromContext(ctx).Get("client_version"))
+	assert.Equal(t, "", MetadataFromContext(ctx).Get("locale"))
+}
@@ -0,0 +1,170 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Metrics receives events from servers and client sessions. It's set with
+// [ServerOptions.Metrics] and [SessionOptions.Metrics]. Events are labeled
+// with the name of the Mach service they relate to. Implementations must be
+// safe for concurrent use. See [NopMetrics] and [ExpvarMetrics].
+type Metrics interface {
+	// MessageReceived is called when a listener receives a message, before
+	// it's handled.
+	MessageReceived(service string)
+	// HandlerDone is called when a [Handler] returns, with the method called
+	// by the client (empty if the message wasn't sent with [Call]), how long
+	// the handler ran, and the code of the error it replied, if any.
+	HandlerDone(service, method string, duration time.Duration, code ErrorCode)
+	// ReplySent is called when a reply is sent, with the approximate size of
+	// its content in bytes.
+	ReplySent(service string, size int)
+	// DecodeError is called when a message, or a reply, can't be decoded.
+	DecodeError(service string)
+	// Panic is called when a [Handler] panics.
+	Panic(service string)
+	// RateLimited is called when a message is rejected by the [RateLimit] of
+	// a listener.
+	RateLimited(service string)
+	// ActivePeers is called with the number of peers connected to a listener
+	// whenever it changes.
+	ActivePeers(service string, n int)
+	// ClientCall is called when a client is done sending a message, and
+	// waiting for its reply if any, with the error returned to the caller.
+	ClientCall(service string, latency time.Duration, err error)
+}
+
+// NopMetrics is a [Metrics] that discards all events. It's used when no
+// Metrics is set.
+//
+// Metrics implementations can embed NopMetrics, such that they only implement
+// the events they care about, and keep compiling when new events are added
+// to the interface.
+type NopMetrics struct{}
+
+func (NopMetrics) MessageReceived(string)                               {}
+func (NopMetrics) HandlerDone(string, string, time.Duration, ErrorCode) {}
+func (NopMetrics) ReplySent(string, int)                                {}
+func (NopMetrics) DecodeError(string)                                   {}
+func (NopMetrics) Panic(string)                                         {}
+func (NopMetrics) RateLimited(string)                                   {}
+func (NopMetrics) ActivePeers(string, int)                              {}
+func (NopMetrics) ClientCall(string, time.Duration, error)              {}
+
+// ExpvarMetrics is a [Metrics] publishing its counters with the expvar
+// package, as a map of services, each holding a map of counters. Durations
+// are summed up in microseconds.
+type ExpvarMetrics struct {
+	root *expvar.Map
+
+	mu       sync.Mutex
+	services map[string]*expvar.Map
+}
+
+// NewExpvarMetrics returns an [ExpvarMetrics] published under name. Like
+// [expvar.Publish], it panics if name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{
+		root:     expvar.NewMap(name),
+		services: map[string]*expvar.Map{},
+	}
+}
+
+func (m *ExpvarMetrics) service(name string) *expvar.Map {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	svc, ok := m.services[name]
+	if !ok {
+		svc = new(expvar.Map).Init()
+		m.services[name] = svc
+		m.root.Set(name, svc)
+	}
+	return svc
+}
+
+func (m *ExpvarMetrics) MessageReceived(service string) {
+	m.service(service).Add("messages_received", 1)
+}
+
+func (m *ExpvarMetrics) HandlerDone(service, method string, duration time.Duration, code ErrorCode) {
+	svc := m.service(service)
+	svc.Add("handled", 1)
+	svc.Add("handler_duration_us", duration.Microseconds())
+	if code != "" {
+		svc.Add("handler_errors", 1)
+	}
+}
+
+func (m *ExpvarMetrics) ReplySent(service string, size int) {
+	svc := m.service(service)
+	svc.Add("replies_sent", 1)
+	svc.Add("reply_bytes", int64(size))
+}
+
+func (m *ExpvarMetrics) DecodeError(service string) {
+	m.service(service).Add("decode_errors", 1)
+}
+
+func (m *ExpvarMetrics) Panic(service string) {
+	m.service(service).Add("panics", 1)
+}
+
+func (m *ExpvarMetrics) RateLimited(service string) {
+	m.service(service).Add("rate_limited", 1)
+}
+
+func (m *ExpvarMetrics) ActivePeers(service string, n int) {
+	v := new(expvar.Int)
+	v.Set(int64(n))
+	m.service(service).Set("active_peers", v)
+}
+
+func (m *ExpvarMetrics) ClientCall(service string, latency time.Duration, err error) {
+	svc := m.service(service)
+	svc.Add("client_calls", 1)
+	svc.Add("client_latency_us", latency.Microseconds())
+	if err != nil {
+		svc.Add("client_errors", 1)
+	}
+}
+
+// objectSize returns the approximate size in bytes of the content of obj:
+// the length of its strings, data and dictionary keys, and the size of its
+// scalar values.
+func objectSize(obj C.xpc_object_t) int {
+	switch C.xpc_get_type(obj) {
+	case C.XPC_TYPE_BOOL:
+		return 1
+	case C.XPC_TYPE_INT64, C.XPC_TYPE_UINT64, C.XPC_TYPE_DOUBLE, C.XPC_TYPE_DATE:
+		return 8
+	case C.XPC_TYPE_UUID:
+		return 16
+	case C.XPC_TYPE_STRING:
+		return int(C.xpc_string_get_length(obj))
+	case C.XPC_TYPE_DATA:
+		return int(C.xpc_data_get_length(obj))
+	case C.XPC_TYPE_ARRAY:
+		size := 0
+		for i := 0; i < int(C.xpc_array_get_count(obj)); i++ {
+			size += objectSize(C.xpc_array_get_value(obj, C.size_t(i)))
+		}
+		return size
+	case C.XPC_TYPE_DICTIONARY:
+		size := 0
+		dictForEach(obj, func(key string, value C.xpc_object_t) bool {
+			size += len(key) + objectSize(value)
+			return true
+		})
+		return size
+	default:
+		return 0
+	}
+}
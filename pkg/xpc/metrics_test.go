@@ -0,0 +1,49 @@
+package xpc
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	// expvar names can't be reused, so use a unique one in case the test
+	// runs several times, like with -count.
+	name := fmt.Sprintf("xpc_test_metrics_%d", time.Now().UnixNano())
+	m := NewExpvarMetrics(name)
+	m.MessageReceived("com.foobar.daemon")
+	m.MessageReceived("com.foobar.daemon")
+	m.HandlerDone("com.foobar.daemon", "ping", 3*time.Millisecond, "")
+	m.HandlerDone("com.foobar.daemon", "add", 2*time.Millisecond, CodeInvalidRequest)
+	m.ReplySent("com.foobar.daemon", 42)
+	m.Panic("com.foobar.daemon")
+	m.RateLimited("com.foobar.daemon")
+	m.ActivePeers("com.foobar.daemon", 2)
+	m.ActivePeers("com.foobar.daemon", 1)
+	m.ClientCall("com.foobar.other", time.Millisecond, errors.New("boom"))
+
+	root, ok := expvar.Get(name).(*expvar.Map)
+	require.True(t, ok)
+	svc, ok := root.Get("com.foobar.daemon").(*expvar.Map)
+	require.True(t, ok)
+
+	assert.Equal(t, "2", svc.Get("messages_received").String())
+	assert.Equal(t, "2", svc.Get("handled").String())
+	assert.Equal(t, "1", svc.Get("handler_errors").String())
+	assert.Equal(t, "5000", svc.Get("handler_duration_us").String())
+	assert.Equal(t, "42", svc.Get("reply_bytes").String())
+	assert.Equal(t, "1", svc.Get("panics").String())
+	assert.Equal(t, "1", svc.Get("rate_limited").String())
+	assert.Equal(t, "1", svc.Get("active_peers").String())
+	assert.Nil(t, svc.Get("client_calls"))
+
+	other, ok := root.Get("com.foobar.other").(*expvar.Map)
+	require.True(t, ok)
+	assert.Equal(t, "1", other.Get("client_calls").String())
+	assert.Equal(t, "1", other.Get("client_errors").String())
+}
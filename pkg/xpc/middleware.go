@@ -0,0 +1,106 @@
+package xpc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+// Middleware wraps a [ContextHandler] to run code before and / or after it.
+// It can be used to implement cross-cutting concerns like logging,
+// authorization or metrics. Middlewares can be set globally through
+// [ServerOptions], or per [Listener]. Details about the message being handled
+// are available through [RequestInfoFromContext].
+type Middleware func(next ContextHandler) ContextHandler
+
+// chain wraps h with middlewares. The first middleware is the outermost one,
+// so it runs first.
+func chain(h ContextHandler, middlewares ...Middleware) ContextHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// AccessLog returns a [Middleware] logging every message handled, along with
+// the identity of the peer, how long it took and whether it failed. Messages
+// whose handler panicked are logged with panicked=true and the
+// [CodeInternal] error code, since the panic is recovered, and the internal
+// error reply sent, only after the middlewares have returned.
+func AccessLog(logger *slog.Logger) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return func(ctx context.Context, session *Session, msg unsafe.Pointer) {
+			info := RequestInfoFromContext(ctx)
+			if info == nil {
+				next(ctx, session, msg)
+				return
+			}
+
+			// Don't recover from panics here, otherwise the stack trace
+			// passed to the PanicHandler wouldn't show where the panic
+			// happened.
+			returned := false
+			defer func() {
+				errorCode := info.ErrorCode()
+				if !returned && errorCode == "" {
+					errorCode = CodeInternal
+				}
+
+				level := slog.LevelInfo
+				if errorCode != "" {
+					level = slog.LevelWarn
+				}
+				logger.LogAttrs(ctx, level, "xpc request",
+					slog.String("service", info.Service),
+					slog.String("method", info.Method),
+					slog.Int("pid", info.Peer.PID),
+					slog.Any("euid", info.Peer.EUID),
+					slog.Duration("duration", time.Since(info.Received)),
+					slog.Bool("replied", info.Replied()),
+					slog.Bool("panicked", !returned),
+					slog.String("error_code", string(errorCode)))
+			}()
+
+			next(ctx, session, msg)
+			returned = true
+		}
+	}
+}
+
+// Authorize returns a [Middleware] calling allow for every message. If it
+// returns an error, the message isn't passed to the next handler, and a
+// permission error reply is sent back to the client.
+func Authorize(allow func(ctx context.Context, peer PeerInfo) error) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return func(ctx context.Context, session *Session, msg unsafe.Pointer) {
+			if err := allow(ctx, session.Peer()); err != nil {
+				ReplyError(session, msg, Errorf(CodePermissionDenied, "%v", err))
+				return
+			}
+			next(ctx, session, msg)
+		}
+	}
+}
+
+// AllowUIDs returns a [Middleware] rejecting messages sent by peers whose
+// effective user ID isn't in uids.
+func AllowUIDs(uids ...uint32) Middleware {
+	return Authorize(func(_ context.Context, peer PeerInfo) error {
+		if slices.Contains(uids, peer.EUID) {
+			return nil
+		}
+		return fmt.Errorf("uid %d is not allowed", peer.EUID)
+	})
+}
+
+// RequireCodeSigning returns a [Middleware] rejecting messages sent by peers
+// that don't satisfy the code signing requirement. See [Listener] for the
+// requirement language.
+func RequireCodeSigning(requirement string) Middleware {
+	return Authorize(func(_ context.Context, peer PeerInfo) error {
+		return peer.CheckRequirement(requirement)
+	})
+}
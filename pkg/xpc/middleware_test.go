@@ -0,0 +1,99 @@
+package xpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next ContextHandler) ContextHandler {
+			return func(ctx context.Context, session *Session, msg unsafe.Pointer) {
+				calls = append(calls, name+":before")
+				next(ctx, session, msg)
+				calls = append(calls, name+":after")
+			}
+		}
+	}
+
+	h := chain(func(context.Context, *Session, unsafe.Pointer) {
+		calls = append(calls, "handler")
+	}, mw("first"), mw("second"))
+	h(context.Background(), &Session{}, nil)
+
+	assert.Equal(t, []string{
+		"first:before",
+		"second:before",
+		"handler",
+		"second:after",
+		"first:after",
+	}, calls)
+}
+
+func TestHandlerWithContext(t *testing.T) {
+	sess := &Session{}
+	var got *Session
+	h := Handler(func(session *Session, _ unsafe.Pointer) {
+		got = session
+	})
+
+	chain(h.withContext(), func(next ContextHandler) ContextHandler {
+		return next
+	})(context.Background(), sess, nil)
+	assert.Same(t, sess, got)
+}
+
+func TestRequestInfoFromContext(t *testing.T) {
+	assert.Nil(t, RequestInfoFromContext(context.Background()))
+
+	info := &RequestInfo{Service: "com.foobar.daemon", Method: "ping"}
+	ctx := withRequestInfo(context.Background(), info)
+	assert.Same(t, info, RequestInfoFromContext(ctx))
+
+	assert.False(t, info.Replied())
+	assert.True(t, info.beginReply())
+	info.endReply(CodeInternal, nil)
+	assert.True(t, info.Replied())
+	assert.Equal(t, CodeInternal, info.ErrorCode())
+}
+
+func TestRequestInfoReplyOnce(t *testing.T) {
+	info := &RequestInfo{}
+
+	// A failed reply can be retried.
+	assert.True(t, info.beginReply())
+	info.endReply("", errors.New("send failed"))
+	assert.False(t, info.Replied())
+
+	assert.True(t, info.beginReply())
+	info.endReply(CodeDeadlineExceeded, nil)
+	assert.False(t, info.beginReply())
+	assert.Equal(t, CodeDeadlineExceeded, info.ErrorCode())
+
+	// Sessions not bound to a message can always reply.
+	var nilInfo *RequestInfo
+	assert.True(t, nilInfo.beginReply())
+}
+
+func TestAccessLogPanic(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	h := chain(func(context.Context, *Session, unsafe.Pointer) {
+		panic("boom")
+	}, AccessLog(logger))
+
+	ctx := withRequestInfo(context.Background(), &RequestInfo{Service: "com.foobar.daemon", Method: "ping"})
+	assert.PanicsWithValue(t, "boom", func() {
+		h(ctx, &Session{}, nil)
+	})
+	assert.Contains(t, buf.String(), "method=ping")
+	assert.Contains(t, buf.String(), "panicked=true error_code=internal")
+}
@@ -0,0 +1,74 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// Object is an XPC object built by [FromJSON] or [FromPlist]. It can be sent
+// with [Send], [SendWaitReply], [Call] or [Reply] like any struct, as long as
+// it's a dictionary. It can also be passed to [Describe], [ToJSON] or
+// [ToPlist], and its [Object.Pointer] to [Unmarshal]. Sending an Object sends
+// a copy of it, so the reserved keys added to messages don't alter it.
+//
+// Objects must be released with [Object.Release] once they're not needed
+// anymore.
+type Object struct {
+	ptr unsafe.Pointer
+}
+
+// Release releases the underlying XPC object. The Object must not be used
+// afterwards.
+func (o Object) Release() {
+	if o.ptr != nil {
+		C.xpc_release((C.xpc_object_t)(o.ptr))
+	}
+}
+
+// Pointer returns the underlying XPC object, like the messages passed to a
+// [Handler]. It's only valid until the Object is released.
+func (o Object) Pointer() unsafe.Pointer {
+	return o.ptr
+}
+
+// isDictionary reports whether o can be sent as a message.
+func (o Object) isDictionary() bool {
+	return o.ptr != nil && C.xpc_get_type((C.xpc_object_t)(o.ptr)) == C.XPC_TYPE_DICTIONARY
+}
+
+// copyObject returns a copy of o's XPC object, which must be released by the
+// caller.
+func (o Object) copyObject() (C.xpc_object_t, error) {
+	if o.ptr == nil {
+		return nil, errors.New("xpc: zero Object")
+	}
+	return C.xpc_copy((C.xpc_object_t)(o.ptr)), nil
+}
+
+// copyInto copies the entries of o, a dictionary, into dst. Like with
+// structs, keys can't start with an underscore.
+func (o Object) copyInto(dst C.xpc_object_t) error {
+	if !o.isDictionary() {
+		return errors.New("xpc: Object isn't a dictionary")
+	}
+
+	var err error
+	dictForEach((C.xpc_object_t)(o.ptr), func(key string, value C.xpc_object_t) bool {
+		if strings.HasPrefix(key, "_") {
+			err = fmt.Errorf("xpc key cannot start with underscore: %s", key)
+			return false
+		}
+		ckey := C.CString(key)
+		defer C.free(unsafe.Pointer(ckey))
+		C.xpc_dictionary_set_value(dst, ckey, value)
+		return true
+	})
+	return err
+}
@@ -0,0 +1,43 @@
+package xpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObject(t *testing.T) {
+	obj, err := FromJSON([]byte(`{"name":"John Doe","age":30}`))
+	require.NoError(t, err)
+	defer obj.Release()
+	assert.True(t, isStruct(obj))
+
+	var got struct {
+		Name string `xpc:"name"`
+		Age  int64  `xpc:"age"`
+	}
+	require.NoError(t, Unmarshal(obj.Pointer(), &got))
+	assert.Equal(t, "John Doe", got.Name)
+	assert.Equal(t, int64(30), got.Age)
+
+	assert.Equal(t, `{"age":30,"name":"John Doe"}`, DescribeCompact(obj))
+
+	arr, err := FromJSON([]byte(`[1,2]`))
+	require.NoError(t, err)
+	defer arr.Release()
+	assert.False(t, isStruct(arr))
+
+	_, err = Marshal(Object{})
+	assert.EqualError(t, err, "xpc: zero Object")
+}
+
+func TestObjectReservedKeys(t *testing.T) {
+	obj, err := FromJSON([]byte(`{"_method":"add"}`))
+	require.NoError(t, err)
+	defer obj.Release()
+
+	dst, err := Marshal(struct{}{})
+	require.NoError(t, err)
+	assert.EqualError(t, marshalIntoDict(dst, obj), "xpc key cannot start with underscore: _method")
+}
@@ -0,0 +1,155 @@
+package xpc
+
+/*
+#import "peer.h"
+
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -lbsm
+*/
+import "C"
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// AuditToken is the raw audit token identifying a process. It's an opaque
+// value that can be passed to other macOS APIs expecting an audit_token_t.
+type AuditToken [8]uint32
+
+// PeerInfo describes the process on the other end of a [Session].
+type PeerInfo struct {
+	// PID is the process ID of the peer. Note that PIDs can be reused, so
+	// prefer the AuditToken to uniquely identify a process.
+	PID int
+	// EUID is the effective user ID of the peer.
+	EUID uint32
+	// EGID is the effective group ID of the peer.
+	EGID uint32
+	// ASID is the audit session ID of the peer.
+	ASID int
+	// AuditToken is the raw audit token of the peer.
+	AuditToken AuditToken
+}
+
+func peerInfoFromMessage(msg unsafe.Pointer) PeerInfo {
+	info := C.get_peer_info((C.xpc_object_t)(msg))
+
+	var token AuditToken
+	for i := range token {
+		token[i] = uint32(info.token.val[i])
+	}
+
+	return PeerInfo{
+		PID:        int(info.pid),
+		EUID:       uint32(info.euid),
+		EGID:       uint32(info.egid),
+		ASID:       int(info.asid),
+		AuditToken: token,
+	}
+}
+
+// CheckRequirement checks whether the peer satisfies the code signing
+// requirement. It returns [ErrRequirementNotSatisfied] if it doesn't. See
+// [Listener] for the requirement language.
+func (p PeerInfo) CheckRequirement(requirement string) error {
+	return checkRequirement(p.AuditToken, requirement)
+}
+
+// SigningIdentifier returns the code signing identifier of the peer, like
+// "com.apple.Safari", or an empty string if it isn't signed.
+func (p PeerInfo) SigningIdentifier() (string, error) {
+	return signingIdentifier(p.AuditToken)
+}
+
+// Peer returns the identity of the peer. For sessions passed to a [Handler],
+// it's the identity of the process that sent the message being handled. It
+// returns a zero value for client sessions.
+//
+// This can be used to authorize operations on a per-message basis, for
+// instance by checking the EUID of the peer, or by calling
+// [PeerInfo.CheckRequirement].
+func (s *Session) Peer() PeerInfo {
+	if s.req != nil {
+		return s.req.Peer
+	}
+	if s.peer != nil {
+		s.peer.mu.Lock()
+		defer s.peer.mu.Unlock()
+		return s.peer.info
+	}
+	return PeerInfo{}
+}
+
+// ErrPeerDisconnected is returned when sending a message to a peer that is
+// disconnected.
+var ErrPeerDisconnected = errors.New("xpc: peer disconnected")
+
+// peerConn holds the state of a peer connected to a [Listener].
+type peerConn struct {
+	// session is a long-lived session for the peer. It's passed to the
+	// OnConnect and OnDisconnect hooks, and returned by [Server.Peers].
+	session *Session
+
+	mu sync.Mutex
+	// connected is true once the OnConnect hook accepted the peer, and
+	// rejected is true if it didn't.
+	connected bool
+	rejected  bool
+	// disconnected is true once the peer's XPC session is released.
+	disconnected bool
+	// info is the identity of the peer, as found in its first message.
+	info  PeerInfo
+	state any
+
+	// signingIdent caches the code signing identifier of the peer, which is
+	// looked up for every audit record otherwise.
+	signingOnce  sync.Once
+	signingIdent string
+}
+
+func newPeerConn(peer unsafe.Pointer) *peerConn {
+	p := &peerConn{}
+	p.session = &Session{sess: peer, peer: p}
+	return p
+}
+
+// signingIdentifier returns the code signing identifier of the peer, as
+// found in the first message audited. It's empty if the peer isn't signed,
+// or if it exited before it could be looked up.
+func (p *peerConn) signingIdentifier(info PeerInfo) string {
+	p.signingOnce.Do(func() {
+		p.signingIdent, _ = info.SigningIdentifier()
+	})
+	return p.signingIdent
+}
+
+// do calls fn with the XPC session of the peer, unless it's disconnected.
+// The session is retained while fn runs, such that p.mu doesn't need to be
+// held while waiting for the peer.
+func (p *peerConn) do(fn func(sess C.xpc_session_t) error) error {
+	p.mu.Lock()
+	if p.disconnected {
+		p.mu.Unlock()
+		return ErrPeerDisconnected
+	}
+	sess := p.session.sess
+	C.xpc_retain((C.xpc_object_t)(sess))
+	p.mu.Unlock()
+
+	defer C.xpc_release((C.xpc_object_t)(sess))
+	return fn((C.xpc_session_t)(sess))
+}
+
+// State returns the state returned by the OnConnect hook of the
+// [Listener] for this peer. It returns nil for client sessions, or if the
+// Listener has no OnConnect hook.
+func (s *Session) State() any {
+	if s.peer == nil {
+		return nil
+	}
+
+	s.peer.mu.Lock()
+	defer s.peer.mu.Unlock()
+	return s.peer.state
+}
@@ -0,0 +1,13 @@
+#import <xpc/xpc.h>
+#import <bsm/libbsm.h>
+
+typedef struct peer_info_t {
+	pid_t pid;
+	uid_t euid;
+	gid_t egid;
+	au_asid_t asid;
+	audit_token_t token;
+} peer_info_t;
+
+// get_peer_info returns the identity of the process that sent msg.
+peer_info_t get_peer_info(xpc_object_t msg);
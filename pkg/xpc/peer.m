@@ -0,0 +1,19 @@
+#import "peer.h"
+
+// xpc_dictionary_get_audit_token isn't part of the public headers, but it has
+// been exported by libxpc for a long time and is the only way to reliably
+// identify the sender of a message.
+extern void xpc_dictionary_get_audit_token(xpc_object_t xdict, audit_token_t *token);
+
+peer_info_t get_peer_info(xpc_object_t msg) {
+	audit_token_t token;
+	xpc_dictionary_get_audit_token(msg, &token);
+
+	return (peer_info_t){
+		.pid = audit_token_to_pid(token),
+		.euid = audit_token_to_euid(token),
+		.egid = audit_token_to_egid(token),
+		.asid = audit_token_to_asid(token),
+		.token = token,
+	};
+}
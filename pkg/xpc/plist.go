@@ -0,0 +1,345 @@
+package xpc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/akerouanton/go-xpc/pkg/xpc/internal/plist"
+)
+
+// PlistFormat is the serialization format of a property list.
+type PlistFormat = plist.Format
+
+const (
+	// PlistXML is the XML format, as used by launchd configuration files.
+	PlistXML = plist.XML
+	// PlistBinary is the binary format, as written by NSKeyedArchiver and
+	// plutil -convert binary1.
+	PlistBinary = plist.Binary
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	fdType   = reflect.TypeOf(FD(0))
+)
+
+// MarshalPlist returns the property list representation of v, in the given
+// format. Structs are encoded as dictionaries, using the same xpc struct tags
+// as [Marshal]:
+//
+//	type Job struct {
+//		Label     string   `xpc:"Label"`
+//		Args      []string `xpc:"ProgramArguments"`
+//		RunAtLoad bool     `xpc:"RunAtLoad"`
+//	}
+//
+// Maps must have string keys. []byte is encoded as data, and time.Time as a
+// date. Property lists don't have a null value, so nil pointers, maps and
+// interfaces are omitted from dictionaries, and rejected elsewhere. File
+// descriptors can't be represented in a property list.
+func MarshalPlist(v any, format PlistFormat) ([]byte, error) {
+	pv, err := toPlistValue(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return plist.Encode(pv, format)
+}
+
+func toPlistValue(v reflect.Value) (any, error) {
+	if !v.IsValid() {
+		return nil, errors.New("nil values can't be represented in a property list")
+	}
+
+	switch v.Type() {
+	case timeType:
+		return v.Interface().(time.Time), nil
+	case fdType:
+		return nil, errors.New("file descriptors can't be represented in a property list")
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		// Property lists have a single integer type, and small values are
+		// decoded as int64.
+		if u := v.Uint(); u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return b, nil
+		}
+		arr := make([]any, v.Len())
+		for i := range arr {
+			item, err := toPlistValue(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			arr[i] = item
+		}
+		return arr, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		dict := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if isNil(iter.Value()) {
+				continue
+			}
+			key := iter.Key().String()
+			item, err := toPlistValue(iter.Value())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			dict[key] = item
+		}
+		return dict, nil
+	case reflect.Struct:
+		dict := make(map[string]any)
+		vtype := v.Type()
+		for i := 0; i < vtype.NumField(); i++ {
+			field := vtype.Field(i)
+			if !field.IsExported() || isNil(v.Field(i)) {
+				continue
+			}
+
+			key := parseFieldTag(field).key
+			if strings.HasPrefix(key, "_") {
+				return nil, fmt.Errorf("xpc key cannot start with underscore: %s", key)
+			}
+
+			item, err := toPlistValue(v.Field(i))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			dict[key] = item
+		}
+		return dict, nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, errors.New("nil values can't be represented in a property list")
+		}
+		return toPlistValue(v.Elem())
+	default:
+		return nil, errors.New("unsupported type: " + v.Kind().String())
+	}
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+// UnmarshalPlist parses a property list, either in the XML or the binary
+// format, and stores the result in the value pointed to by v. It follows the
+// mapping described by [MarshalPlist]. Dictionary keys that don't match any
+// struct field are ignored, such that only the relevant parts of a launchd
+// configuration file can be decoded. Integers are checked for overflow, and
+// can be decoded into floats. Values decoded into an empty interface use the
+// following types: map[string]any, []any, string, int64, uint64 (for integers
+// larger than math.MaxInt64), float64, bool, []byte and time.Time.
+func UnmarshalPlist(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("unmarshal target must be a non-nil pointer")
+	}
+
+	pv, _, err := plist.Decode(data)
+	if err != nil {
+		return err
+	}
+	return fromPlistValue(pv, rv.Elem())
+}
+
+func fromPlistValue(pv any, v reflect.Value) error {
+	mismatch := func() error {
+		return fmt.Errorf("cannot unmarshal %s into %s", plistTypeName(pv), v.Type())
+	}
+
+	switch v.Type() {
+	case timeType:
+		t, ok := pv.(time.Time)
+		if !ok {
+			return mismatch()
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case fdType:
+		return errors.New("file descriptors can't be represented in a property list")
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, ok := pv.(bool)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := pv.(int64)
+		if !ok || v.OverflowInt(i) {
+			return mismatch()
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch n := pv.(type) {
+		case int64:
+			if n < 0 {
+				return mismatch()
+			}
+			u = uint64(n)
+		case uint64:
+			u = n
+		default:
+			return mismatch()
+		}
+		if v.OverflowUint(u) {
+			return mismatch()
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch n := pv.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		case uint64:
+			v.SetFloat(float64(n))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		s, ok := pv.(string)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if b, ok := pv.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		arr, ok := pv.([]any)
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+		for i, item := range arr {
+			if err := fromPlistValue(item, slice.Index(i)); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if b, ok := pv.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(b) != v.Len() {
+				return mismatch()
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		arr, ok := pv.([]any)
+		if !ok || len(arr) > v.Len() {
+			return mismatch()
+		}
+		v.SetZero()
+		for i, item := range arr {
+			if err := fromPlistValue(item, v.Index(i)); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	case reflect.Map:
+		dict, ok := pv.(map[string]any)
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(dict)))
+		}
+		for key, item := range dict {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := fromPlistValue(item, elem); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		dict, ok := pv.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		vtype := v.Type()
+		for i := 0; i < vtype.NumField(); i++ {
+			field := vtype.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			key := parseFieldTag(field).key
+			item, ok := dict[key]
+			if !ok {
+				continue
+			}
+			if err := fromPlistValue(item, v.Field(i)); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return fromPlistValue(pv, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch()
+		}
+		v.Set(reflect.ValueOf(pv))
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+func plistTypeName(pv any) string {
+	switch pv.(type) {
+	case map[string]any:
+		return "dictionary"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case int64, uint64:
+		return "integer"
+	case float64:
+		return "real"
+	case bool:
+		return "boolean"
+	case []byte:
+		return "data"
+	case time.Time:
+		return "date"
+	default:
+		return fmt.Sprintf("%T", pv)
+	}
+}
@@ -0,0 +1,211 @@
+package xpc
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type plistJob struct {
+	Label        string            `xpc:"Label"`
+	Args         []string          `xpc:"ProgramArguments"`
+	RunAtLoad    bool              `xpc:"RunAtLoad"`
+	Nice         int8              `xpc:"Nice"`
+	MachServices map[string]bool   `xpc:"MachServices"`
+	Env          map[string]string `xpc:"EnvironmentVariables"`
+	Token        []byte            `xpc:"Token,secret"`
+	Updated      time.Time         `xpc:"Updated"`
+	Throttle     *uint32           `xpc:"ThrottleInterval"`
+	Ratio        float32
+	Extra        any
+	internal     string
+}
+
+func TestPlistRoundTrip(t *testing.T) {
+	throttle := uint32(10)
+	job := plistJob{
+		Label:        "com.foobar.daemon",
+		Args:         []string{"/usr/local/bin/daemon", "--verbose"},
+		RunAtLoad:    true,
+		Nice:         -5,
+		MachServices: map[string]bool{"com.foobar.daemon.rpc": true},
+		Env:          map[string]string{},
+		Token:        []byte{0xDE, 0xAD},
+		Updated:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Throttle:     &throttle,
+		Ratio:        0.5,
+		Extra:        []any{"a", int64(1), uint64(math.MaxUint64)},
+	}
+
+	for _, format := range []PlistFormat{PlistXML, PlistBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			data, err := MarshalPlist(job, format)
+			require.NoError(t, err)
+
+			var got plistJob
+			require.NoError(t, UnmarshalPlist(data, &got))
+			assert.Equal(t, job, got)
+		})
+	}
+}
+
+func TestMarshalPlistOmitsNil(t *testing.T) {
+	data, err := MarshalPlist(plistJob{Label: "a"}, PlistXML)
+	require.NoError(t, err)
+
+	var got map[string]any
+	require.NoError(t, UnmarshalPlist(data, &got))
+	assert.Equal(t, map[string]any{
+		"Label":            "a",
+		"ProgramArguments": []any{},
+		"RunAtLoad":        false,
+		"Nice":             int64(0),
+		"Token":            []byte{},
+		"Updated":          time.Time{},
+		"Ratio":            0.0,
+	}, got)
+}
+
+func TestUnmarshalPlistLaunchd(t *testing.T) {
+	data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>com.foobar.daemon</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>/usr/local/bin/daemon</string>
+	</array>
+	<key>MachServices</key>
+	<dict>
+		<key>com.foobar.daemon.rpc</key>
+		<true/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>30</integer>
+	<key>Ratio</key>
+	<integer>2</integer>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+</dict>
+</plist>`)
+
+	var got plistJob
+	require.NoError(t, UnmarshalPlist(data, &got))
+
+	throttle := uint32(30)
+	assert.Equal(t, plistJob{
+		Label:        "com.foobar.daemon",
+		Args:         []string{"/usr/local/bin/daemon"},
+		MachServices: map[string]bool{"com.foobar.daemon.rpc": true},
+		Throttle:     &throttle,
+		Ratio:        2,
+	}, got)
+}
+
+func TestMarshalPlistErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		err  string
+	}{
+		{name: "nil", v: nil, err: "nil values can't be represented in a property list"},
+		{name: "nil array item", v: []*int{nil}, err: "[0]: nil values can't be represented in a property list"},
+		{name: "fd", v: struct{ F FD }{}, err: "F: file descriptors can't be represented in a property list"},
+		{name: "map key", v: map[int]string{}, err: "unsupported map key type int"},
+		{name: "reserved key", v: struct {
+			A int `xpc:"_a"`
+		}{}, err: "xpc key cannot start with underscore: _a"},
+		{name: "func", v: func() {}, err: "unsupported type: func"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := MarshalPlist(tt.v, PlistXML)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestUnmarshalPlistErrors(t *testing.T) {
+	type target struct {
+		Label            string   `xpc:"Label"`
+		Nice             int8     `xpc:"Nice"`
+		ThrottleInterval uint32   `xpc:"ThrottleInterval"`
+		ProgramArguments []string `xpc:"ProgramArguments"`
+	}
+
+	tests := []struct {
+		name string
+		v    map[string]any
+		err  string
+	}{
+		{name: "type mismatch", v: map[string]any{"Label": int64(1)}, err: "Label: cannot unmarshal integer into string"},
+		{name: "int overflow", v: map[string]any{"Nice": int64(200)}, err: "Nice: cannot unmarshal integer into int8"},
+		{name: "negative uint", v: map[string]any{"ThrottleInterval": int64(-1)}, err: "ThrottleInterval: cannot unmarshal integer into uint32"},
+		{name: "array item", v: map[string]any{"ProgramArguments": []any{"a", true}}, err: "ProgramArguments: [1]: cannot unmarshal boolean into string"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := MarshalPlist(tt.v, PlistBinary)
+			require.NoError(t, err)
+
+			var got target
+			assert.EqualError(t, UnmarshalPlist(data, &got), tt.err)
+		})
+	}
+
+	var v target
+	assert.EqualError(t, UnmarshalPlist(nil, v), "unmarshal target must be a non-nil pointer")
+	assert.Error(t, UnmarshalPlist([]byte("not a plist"), &v))
+}
+
+func TestPlistObjectRoundTrip(t *testing.T) {
+	obj, err := FromJSON([]byte(`{"a":1,"b":1.5,"c":{"$uint64":"18446744073709551615"},"d":{"$data":"AQI="},` +
+		`"e":{"$date":"2024-01-02T03:04:05Z"},"f":[true,"x"],"g":{}}`))
+	require.NoError(t, err)
+	defer obj.Release()
+
+	for _, format := range []PlistFormat{PlistXML, PlistBinary} {
+		data, err := ToPlist(obj, format)
+		require.NoError(t, err)
+
+		got, err := FromPlist(data)
+		require.NoError(t, err)
+
+		out, err := ToJSON(got)
+		got.Release()
+		require.NoError(t, err)
+		assert.Equal(t, `{"a":1,"b":1.5,"c":{"$uint64":"18446744073709551615"},"d":{"$data":"AQI="},`+
+			`"e":{"$date":"2024-01-02T03:04:05Z"},"f":[true,"x"],"g":{}}`, string(out))
+	}
+
+	null, err := FromJSON([]byte(`{"a":null}`))
+	require.NoError(t, err)
+	defer null.Release()
+	_, err = ToPlist(null, PlistXML)
+	assert.EqualError(t, err, "a: null values can't be converted to a property list")
+}
+
+func TestFromPlistDateRange(t *testing.T) {
+	for _, format := range []PlistFormat{PlistXML, PlistBinary} {
+		data, err := MarshalPlist(map[string]time.Time{"d": time.Date(4001, 1, 1, 0, 0, 0, 0, time.UTC)}, format)
+		require.NoError(t, err)
+
+		// XPC dates can't hold it, but the property list can.
+		_, err = FromPlist(data)
+		assert.ErrorContains(t, err, "date 4001-01-01T00:00:00Z is out of range")
+
+		var got map[string]time.Time
+		require.NoError(t, UnmarshalPlist(data, &got))
+		assert.Equal(t, time.Date(4001, 1, 1, 0, 0, 0, 0, time.UTC), got["d"])
+	}
+}
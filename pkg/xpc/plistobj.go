@@ -0,0 +1,159 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/akerouanton/go-xpc/pkg/xpc/internal/plist"
+)
+
+// FromPlist converts a property list, either in the XML or the binary format,
+// into an XPC [Object], which must be released by the caller. Integers become
+// int64, or uint64 if they're too large for an int64. Dates must be between
+// the years 1678 and 2262, as XPC stores them as nanoseconds since the Unix
+// epoch.
+func FromPlist(data []byte) (Object, error) {
+	pv, _, err := plist.Decode(data)
+	if err != nil {
+		return Object{}, err
+	}
+	obj, err := fromPlistObject(pv)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ptr: unsafe.Pointer(obj)}, nil
+}
+
+func fromPlistObject(pv any) (C.xpc_object_t, error) {
+	switch v := pv.(type) {
+	case bool:
+		return C.xpc_bool_create(C.bool(v)), nil
+	case int64:
+		return C.xpc_int64_create(C.int64_t(v)), nil
+	case uint64:
+		return C.xpc_uint64_create(C.uint64_t(v)), nil
+	case float64:
+		return C.xpc_double_create(C.double(v)), nil
+	case string:
+		cs := C.CString(v)
+		defer C.free(unsafe.Pointer(cs))
+		return C.xpc_string_create(cs), nil
+	case []byte:
+		if len(v) == 0 {
+			return C.xpc_data_create(nil, 0), nil
+		}
+		return C.xpc_data_create(unsafe.Pointer(&v[0]), C.size_t(len(v))), nil
+	case time.Time:
+		if v.Before(minDate) || v.After(maxDate) {
+			return nil, fmt.Errorf("date %s is out of range", v.Format(time.RFC3339))
+		}
+		return C.xpc_date_create(C.int64_t(v.UnixNano())), nil
+	case []any:
+		arr := C.xpc_array_create_empty()
+		for _, item := range v {
+			obj, err := fromPlistObject(item)
+			if err != nil {
+				C.xpc_release(arr)
+				return nil, err
+			}
+			C.xpc_array_append_value(arr, obj)
+			C.xpc_release(obj)
+		}
+		return arr, nil
+	case map[string]any:
+		dict := C.xpc_dictionary_create_empty()
+		for key, item := range v {
+			obj, err := fromPlistObject(item)
+			if err != nil {
+				C.xpc_release(dict)
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			ckey := C.CString(key)
+			C.xpc_dictionary_set_value(dict, ckey, obj)
+			C.free(unsafe.Pointer(ckey))
+			C.xpc_release(obj)
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("unsupported property list value %T", v)
+	}
+}
+
+// ToPlist converts an XPC object into a property list, in the given format.
+// UUIDs are written as strings, since property lists don't have an equivalent
+// type. It returns an error if obj holds a null value or a file descriptor.
+//
+// Like [Describe], v is either an unsafe.Pointer to an XPC object, or a Go
+// value which is passed through [Marshal] first. See [MarshalPlist] to encode
+// Go values without going through XPC objects.
+func ToPlist(v any, format PlistFormat) ([]byte, error) {
+	obj, release, err := toXPCObject(v)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	pv, err := toPlistObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return plist.Encode(pv, format)
+}
+
+func toPlistObject(obj C.xpc_object_t) (any, error) {
+	if obj == nil {
+		return nil, errors.New("null values can't be converted to a property list")
+	}
+
+	switch C.xpc_get_type(obj) {
+	case C.XPC_TYPE_BOOL:
+		return bool(C.xpc_bool_get_value(obj)), nil
+	case C.XPC_TYPE_INT64:
+		return int64(C.xpc_int64_get_value(obj)), nil
+	case C.XPC_TYPE_UINT64:
+		return uint64(C.xpc_uint64_get_value(obj)), nil
+	case C.XPC_TYPE_DOUBLE:
+		return float64(C.xpc_double_get_value(obj)), nil
+	case C.XPC_TYPE_STRING:
+		return C.GoString(C.xpc_string_get_string_ptr(obj)), nil
+	case C.XPC_TYPE_DATA:
+		return C.GoBytes(C.xpc_data_get_bytes_ptr(obj), C.int(C.xpc_data_get_length(obj))), nil
+	case C.XPC_TYPE_DATE:
+		return time.Unix(0, int64(C.xpc_date_get_value(obj))).UTC(), nil
+	case C.XPC_TYPE_UUID:
+		return formatUUID(C.GoBytes(unsafe.Pointer(C.xpc_uuid_get_bytes(obj)), 16)), nil
+	case C.XPC_TYPE_ARRAY:
+		arr := make([]any, int(C.xpc_array_get_count(obj)))
+		for i := range arr {
+			item, err := toPlistObject(C.xpc_array_get_value(obj, C.size_t(i)))
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = item
+		}
+		return arr, nil
+	case C.XPC_TYPE_DICTIONARY:
+		dict := make(map[string]any)
+		for _, key := range dictKeys(obj) {
+			item, err := toPlistObject(dictValue(obj, key))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			dict[key] = item
+		}
+		return dict, nil
+	case C.XPC_TYPE_NULL:
+		return nil, errors.New("null values can't be converted to a property list")
+	case C.XPC_TYPE_FD:
+		return nil, errors.New("file descriptors can't be converted to a property list")
+	default:
+		return nil, fmt.Errorf("unsupported XPC type %s", typeName(obj))
+	}
+}
@@ -0,0 +1,230 @@
+package xpc
+
+import (
+	"context"
+	"fmt"
+	"os/user"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Policy restricts which peers can call a method of a [Listener]. It's
+// evaluated for every message, against the credentials of the peer that sent
+// it. See [Listener.Policies].
+//
+// Once a Listener has policies, messages are denied by default: calling a
+// method without a policy of its own is only allowed by the default policy,
+// whose Method is empty, if there's one.
+//
+// A peer is allowed if its effective user ID is in AllowUIDs, or if it's a
+// member of one of the AllowGroups -- unless both are empty, in which case
+// any user is allowed. If Requirement is set, the peer must also satisfy that
+// code signing requirement.
+type Policy struct {
+	// Method is the method the policy applies to, as set by [Call]. The policy
+	// with an empty Method is the default policy: it applies to the messages
+	// sent to methods without a policy of their own, and to the messages sent
+	// without a method. Without a default policy, those messages are denied.
+	Method string
+	// AllowUIDs lists the effective user IDs allowed to call the method.
+	AllowUIDs []uint32
+	// AllowGroups lists the names of the groups whose members are allowed to
+	// call the method, like "admin".
+	AllowGroups []string
+	// Requirement is a code signing requirement the peer must satisfy. See
+	// [Listener] for the requirement language.
+	Requirement string
+}
+
+// PolicyDenial describes a message rejected by a [Policy]. It's passed to
+// [ServerOptions.OnPolicyDenied].
+type PolicyDenial struct {
+	// Service is the name of the [Listener] that received the message.
+	Service string
+	// Method is the method called by the client, if any.
+	Method string
+	// Peer is the identity of the process that sent the message.
+	Peer PeerInfo
+	// Policy is the policy that rejected the message. It's the zero Policy
+	// if no policy applies to the method, and there's no default policy.
+	Policy Policy
+	// Reason explains why the peer isn't allowed.
+	Reason error
+}
+
+// compiledPolicy is a [Policy] whose groups are resolved to group IDs.
+type compiledPolicy struct {
+	Policy
+	gids []string
+	// groups caches the group IDs of peers. It's shared by all the policies
+	// of a listener.
+	groups *groupIDsCache
+}
+
+// groupIDsCacheTTL is how long the groups a user is a member of are cached.
+// Looking them up can be slow, since it may go through Open Directory.
+const groupIDsCacheTTL = time.Minute
+
+// groupIDsCache caches the result of [lookupGroupIDs], per user ID.
+type groupIDsCache struct {
+	mu      sync.Mutex
+	entries map[uint32]groupIDsEntry
+}
+
+type groupIDsEntry struct {
+	gids    []string
+	err     error
+	expires time.Time
+}
+
+func newGroupIDsCache() *groupIDsCache {
+	return &groupIDsCache{entries: map[uint32]groupIDsEntry{}}
+}
+
+// lookup returns the IDs of the groups the user uid is a member of, from the
+// cache if they were looked up less than [groupIDsCacheTTL] ago. Expired
+// entries are pruned as new ones are added. A nil cache always looks them up.
+func (c *groupIDsCache) lookup(uid uint32, now time.Time) ([]string, error) {
+	if c == nil {
+		return lookupGroupIDs(uid)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[uid]; ok && now.Before(e.expires) {
+		return e.gids, e.err
+	}
+
+	gids, err := lookupGroupIDs(uid)
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[uid] = groupIDsEntry{gids: gids, err: err, expires: now.Add(groupIDsCacheTTL)}
+	return gids, err
+}
+
+// lookupGroupIDs returns the IDs of the groups the user uid is a member of.
+// It's a variable so that tests can replace it.
+var lookupGroupIDs = func(uid uint32) ([]string, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	return u.GroupIds()
+}
+
+// lookupGroup returns the ID of the group name. It's a variable so that tests
+// can replace it.
+var lookupGroup = func(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// enforcePolicies returns a [Middleware] rejecting messages not allowed by
+// policies, including those sent to a method without a policy when there's no
+// default policy. Denials are reported to onDenied, if not nil.
+func enforcePolicies(policies []Policy, onDenied func(ctx context.Context, denial PolicyDenial)) (Middleware, error) {
+	byMethod := make(map[string]*compiledPolicy, len(policies))
+	groups := newGroupIDsCache()
+	for _, p := range policies {
+		if _, ok := byMethod[p.Method]; ok {
+			return nil, fmt.Errorf("duplicate policy for method %q", p.Method)
+		}
+
+		cp := &compiledPolicy{Policy: p, groups: groups}
+		for _, name := range p.AllowGroups {
+			gid, err := lookupGroup(name)
+			if err != nil {
+				return nil, fmt.Errorf("policy for method %q: %w", p.Method, err)
+			}
+			cp.gids = append(cp.gids, gid)
+		}
+		byMethod[p.Method] = cp
+	}
+
+	return func(next ContextHandler) ContextHandler {
+		return func(ctx context.Context, session *Session, msg unsafe.Pointer) {
+			method := messageMethod(msg)
+			peer := session.Peer()
+			p, err := policyFor(byMethod, method)
+			if err == nil {
+				err = p.check(peer)
+			}
+			if err != nil {
+				if onDenied != nil {
+					onDenied(ctx, PolicyDenial{
+						Service: serviceFromContext(ctx),
+						Method:  method,
+						Peer:    peer,
+						Policy:  p.Policy,
+						Reason:  err,
+					})
+				}
+				ReplyError(session, msg, Errorf(CodePermissionDenied, "%v", err))
+				return
+			}
+			next(ctx, session, msg)
+		}
+	}, nil
+}
+
+// policyFor returns the policy applying to method, falling back to the
+// default policy. If there's none, it returns an empty policy and an error.
+func policyFor(byMethod map[string]*compiledPolicy, method string) (*compiledPolicy, error) {
+	if p, ok := byMethod[method]; ok {
+		return p, nil
+	}
+	if p, ok := byMethod[""]; ok {
+		return p, nil
+	}
+	return &compiledPolicy{}, fmt.Errorf("no policy allows method %q", method)
+}
+
+// check returns an error if peer isn't allowed by the policy.
+func (p *compiledPolicy) check(peer PeerInfo) error {
+	if len(p.AllowUIDs) > 0 || len(p.gids) > 0 {
+		if !slices.Contains(p.AllowUIDs, peer.EUID) && !p.inGroups(peer) {
+			return fmt.Errorf("uid %d is not allowed", peer.EUID)
+		}
+	}
+	if p.Requirement != "" {
+		return peer.CheckRequirement(p.Requirement)
+	}
+	return nil
+}
+
+// inGroups returns whether peer is a member of one of the policy's groups,
+// either through its effective group ID, or through its user's groups.
+func (p *compiledPolicy) inGroups(peer PeerInfo) bool {
+	if len(p.gids) == 0 {
+		return false
+	}
+	if slices.Contains(p.gids, strconv.FormatUint(uint64(peer.EGID), 10)) {
+		return true
+	}
+
+	gids, err := p.groups.lookup(peer.EUID, time.Now())
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(gids, func(gid string) bool {
+		return slices.Contains(p.gids, gid)
+	})
+}
+
+// serviceFromContext returns the name of the listener handling the message.
+func serviceFromContext(ctx context.Context) string {
+	if info := RequestInfoFromContext(ctx); info != nil {
+		return info.Service
+	}
+	return ""
+}
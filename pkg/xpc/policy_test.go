@@ -0,0 +1,109 @@
+package xpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stubGroups(t *testing.T, groups map[string]string, members map[uint32][]string) {
+	origGroup, origGroupIDs := lookupGroup, lookupGroupIDs
+	t.Cleanup(func() {
+		lookupGroup, lookupGroupIDs = origGroup, origGroupIDs
+	})
+
+	lookupGroup = func(name string) (string, error) {
+		if gid, ok := groups[name]; ok {
+			return gid, nil
+		}
+		return "", errors.New("unknown group " + name)
+	}
+	lookupGroupIDs = func(uid uint32) ([]string, error) {
+		return members[uid], nil
+	}
+}
+
+func TestEnforcePoliciesValidation(t *testing.T) {
+	stubGroups(t, map[string]string{"admin": "80"}, nil)
+
+	_, err := enforcePolicies([]Policy{{Method: "add"}, {Method: "add"}}, nil)
+	assert.ErrorContains(t, err, `duplicate policy for method "add"`)
+
+	_, err = enforcePolicies([]Policy{{Method: "add", AllowGroups: []string{"wheel"}}}, nil)
+	assert.ErrorContains(t, err, "unknown group wheel")
+
+	_, err = enforcePolicies([]Policy{{Method: "add", AllowGroups: []string{"admin"}}, {}}, nil)
+	assert.NoError(t, err)
+}
+
+func TestPolicyCheck(t *testing.T) {
+	stubGroups(t, map[string]string{"admin": "80"}, map[uint32][]string{
+		501: {"20", "80"},
+		502: {"20"},
+	})
+
+	open := &compiledPolicy{}
+	assert.NoError(t, open.check(PeerInfo{EUID: 502}))
+
+	byUID := &compiledPolicy{Policy: Policy{AllowUIDs: []uint32{0}}}
+	assert.NoError(t, byUID.check(PeerInfo{EUID: 0}))
+	assert.EqualError(t, byUID.check(PeerInfo{EUID: 502}), "uid 502 is not allowed")
+
+	byGroup := &compiledPolicy{Policy: Policy{AllowUIDs: []uint32{0}, AllowGroups: []string{"admin"}}, gids: []string{"80"}}
+	assert.NoError(t, byGroup.check(PeerInfo{EUID: 0}))
+	// Member through its user's groups.
+	assert.NoError(t, byGroup.check(PeerInfo{EUID: 501, EGID: 20}))
+	// Member through its effective group ID.
+	assert.NoError(t, byGroup.check(PeerInfo{EUID: 503, EGID: 80}))
+	require.Error(t, byGroup.check(PeerInfo{EUID: 502, EGID: 20}))
+}
+
+func TestPolicyFor(t *testing.T) {
+	add := &compiledPolicy{Policy: Policy{Method: "add"}}
+	p, err := policyFor(map[string]*compiledPolicy{"add": add}, "add")
+	require.NoError(t, err)
+	assert.Same(t, add, p)
+
+	// Methods without a policy are denied by default.
+	_, err = policyFor(map[string]*compiledPolicy{"add": add}, "sub")
+	assert.EqualError(t, err, `no policy allows method "sub"`)
+	_, err = policyFor(map[string]*compiledPolicy{"add": add}, "")
+	assert.Error(t, err)
+
+	def := &compiledPolicy{}
+	p, err = policyFor(map[string]*compiledPolicy{"add": add, "": def}, "sub")
+	require.NoError(t, err)
+	assert.Same(t, def, p)
+}
+
+func TestGroupIDsCache(t *testing.T) {
+	stubGroups(t, nil, map[uint32][]string{501: {"20", "80"}})
+	lookups := 0
+	lookup := lookupGroupIDs
+	lookupGroupIDs = func(uid uint32) ([]string, error) {
+		lookups++
+		return lookup(uid)
+	}
+
+	c := newGroupIDsCache()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		gids, err := c.lookup(501, now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"20", "80"}, gids)
+	}
+	assert.Equal(t, 1, lookups)
+
+	_, err := c.lookup(502, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, lookups)
+
+	// Expired entries are looked up again, and pruned.
+	_, err = c.lookup(501, now.Add(groupIDsCacheTTL))
+	require.NoError(t, err)
+	assert.Equal(t, 3, lookups)
+	assert.Len(t, c.entries, 1)
+}
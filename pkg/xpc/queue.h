@@ -0,0 +1,5 @@
+#import <dispatch/dispatch.h>
+
+// drain_queue blocks until all the blocks submitted to queue so far have
+// completed.
+void drain_queue(dispatch_queue_t queue);
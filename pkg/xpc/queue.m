@@ -0,0 +1,5 @@
+#import "queue.h"
+
+void drain_queue(dispatch_queue_t queue) {
+	dispatch_barrier_sync(queue, ^{});
+}
@@ -0,0 +1,120 @@
+package xpc
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the rate at which each peer can send messages to a
+// [Listener], with a token bucket: a peer can send up to Burst messages at
+// once, and then Rate messages per second. Messages over the limit aren't
+// handled: clients get a [CodeRateLimited] error reply if they wait for one,
+// and messages sent with [Send] are dropped silently.
+type RateLimit struct {
+	// Rate is the number of messages per second a peer can send.
+	Rate float64
+	// Burst is the maximum number of messages a peer can send at once. It
+	// defaults to Rate, rounded up.
+	Burst int
+	// By tells how peers are told apart. Defaults to [RateLimitByPeer].
+	By RateLimitKey
+}
+
+// RateLimitKey identifies the peers sharing a same token bucket.
+type RateLimitKey int
+
+const (
+	// RateLimitByPeer gives each process its own token bucket, based on its
+	// audit token.
+	RateLimitByPeer RateLimitKey = iota
+	// RateLimitByUID gives all the processes of a user a single token bucket,
+	// such that a user can't bypass the limit by spawning more processes.
+	RateLimitByUID
+)
+
+// idleBucketsPruneInterval is how often buckets that are full, and thus
+// equivalent to no bucket, are removed.
+const idleBucketsPruneInterval = time.Minute
+
+type rateLimitBucketKey struct {
+	uid   uint32
+	token AuditToken
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets of all the peers of a listener.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	by    RateLimitKey
+
+	mu        sync.Mutex
+	buckets   map[rateLimitBucketKey]*bucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(cfg RateLimit) (*rateLimiter, error) {
+	if cfg.Rate <= 0 || math.IsInf(cfg.Rate, 0) || math.IsNaN(cfg.Rate) {
+		return nil, errors.New("rate limit must be a positive number")
+	}
+
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = math.Ceil(cfg.Rate)
+	}
+
+	return &rateLimiter{
+		rate:    cfg.Rate,
+		burst:   burst,
+		by:      cfg.By,
+		buckets: map[rateLimitBucketKey]*bucket{},
+	}, nil
+}
+
+// allow takes a token from the bucket of peer, and returns false if there's
+// none left.
+func (r *rateLimiter) allow(peer PeerInfo, now time.Time) bool {
+	key := rateLimitBucketKey{uid: peer.EUID}
+	if r.by == RateLimitByPeer {
+		key.token = peer.AuditToken
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastPrune) >= idleBucketsPruneInterval {
+		r.prune(now)
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(r.burst, b.tokens+elapsed.Seconds()*r.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes the buckets that would be full by now.
+func (r *rateLimiter) prune(now time.Time) {
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastPrune = now
+}
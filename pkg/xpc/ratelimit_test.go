@@ -0,0 +1,61 @@
+package xpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	_, err := newRateLimiter(RateLimit{})
+	assert.Error(t, err)
+
+	r, err := newRateLimiter(RateLimit{Rate: 2.5})
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, r.burst)
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	r, err := newRateLimiter(RateLimit{Rate: 1, Burst: 2})
+	require.NoError(t, err)
+
+	peer := PeerInfo{PID: 42, EUID: 501, AuditToken: AuditToken{1}}
+	other := PeerInfo{PID: 43, EUID: 501, AuditToken: AuditToken{2}}
+	now := time.Now()
+
+	assert.True(t, r.allow(peer, now))
+	assert.True(t, r.allow(peer, now))
+	assert.False(t, r.allow(peer, now))
+	// Peers have their own bucket.
+	assert.True(t, r.allow(other, now))
+
+	// Tokens are refilled over time, up to the burst.
+	assert.False(t, r.allow(peer, now.Add(500*time.Millisecond)))
+	assert.True(t, r.allow(peer, now.Add(time.Second)))
+	assert.True(t, r.allow(peer, now.Add(time.Hour)))
+	assert.True(t, r.allow(peer, now.Add(time.Hour)))
+	assert.False(t, r.allow(peer, now.Add(time.Hour)))
+}
+
+func TestRateLimiterByUID(t *testing.T) {
+	r, err := newRateLimiter(RateLimit{Rate: 1, By: RateLimitByUID})
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.True(t, r.allow(PeerInfo{EUID: 501, AuditToken: AuditToken{1}}, now))
+	assert.False(t, r.allow(PeerInfo{EUID: 501, AuditToken: AuditToken{2}}, now))
+	assert.True(t, r.allow(PeerInfo{EUID: 502, AuditToken: AuditToken{3}}, now))
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	r, err := newRateLimiter(RateLimit{Rate: 1})
+	require.NoError(t, err)
+
+	now := time.Now()
+	r.allow(PeerInfo{AuditToken: AuditToken{1}}, now)
+	r.allow(PeerInfo{AuditToken: AuditToken{2}}, now.Add(idleBucketsPruneInterval))
+	r.allow(PeerInfo{AuditToken: AuditToken{3}}, now.Add(2*idleBucketsPruneInterval))
+	assert.Len(t, r.buckets, 1)
+}
@@ -0,0 +1,103 @@
+package xpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RequestInfo describes a message being handled by a [Listener]. Handlers and
+// middlewares can retrieve it with [RequestInfoFromContext].
+type RequestInfo struct {
+	// Service is the name of the [Listener] that received the message.
+	Service string
+	// Method is the method called by the client through [Call]. It's empty
+	// if the message was sent with [Send] or [SendWaitReply].
+	Method string
+	// Peer is the identity of the process that sent the message.
+	Peer PeerInfo
+	// Received is the time at which the message started being processed.
+	Received time.Time
+	// Metadata is the [Metadata] sent by the client along with the message.
+	Metadata Metadata
+
+	// metrics is the Metrics of the server that received the message.
+	metrics Metrics
+
+	mu        sync.Mutex
+	replied   bool
+	errorCode ErrorCode
+}
+
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the [RequestInfo] of the message being
+// handled, or nil if ctx wasn't passed to a [ContextHandler].
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+func withRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// Replied returns whether a reply has been sent for this message.
+func (r *RequestInfo) Replied() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replied
+}
+
+// ErrorCode returns the code of the error reply sent for this message, or an
+// empty string if no error reply was sent.
+func (r *RequestInfo) ErrorCode() ErrorCode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.errorCode
+}
+
+// beginReply marks the message as replied, and returns false if it already
+// was -- for instance, because the handler replied after its deadline, when a
+// timeout error reply was already sent. A message must be replied at most once.
+func (r *RequestInfo) beginReply() bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replied {
+		return false
+	}
+	r.replied = true
+	return true
+}
+
+// endReply records the outcome of a reply started with beginReply. If the
+// reply couldn't be sent, the message can be replied again.
+func (r *RequestInfo) endReply(errorCode ErrorCode, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.replied = false
+		return
+	}
+	r.errorCode = errorCode
+}
+
+// serverMetrics returns the [Metrics] set on the server that received the
+// message, or nil if none was set.
+func (r *RequestInfo) serverMetrics() Metrics {
+	if r == nil {
+		return nil
+	}
+	if _, ok := r.metrics.(NopMetrics); ok {
+		return nil
+	}
+	return r.metrics
+}
@@ -0,0 +1,74 @@
+package xpc
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// RetryPolicy controls how a client [Session] recovers from errors flagged as
+// retryable by XPC (see [RichError.CanRetry]), typically because the remote
+// service was restarted by launchd, or by the server (see
+// [RemoteError.Retryable]).
+//
+// When a call fails with a retryable XPC error, the underlying XPC session is
+// transparently re-created. In both cases, the message is then resent, after
+// an exponential backoff, only if it is marked as idempotent (see
+// [Idempotent]). Other messages return the original error, but subsequent
+// calls will use the new session.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an idempotent message is
+	// sent, including the first attempt. A value lower than 2 disables
+	// resending.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first resend.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier is the factor applied to the backoff after each attempt. A
+	// value lower than 1 is treated as 1.
+	Multiplier float64
+}
+
+// DefaultRetryPolicy is a sensible retry policy for clients talking to a
+// daemon that might be restarted at any time.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// Idempotent can be implemented by message types to indicate whether they can
+// safely be sent multiple times. Only messages implementing this interface and
+// returning true are resent by a [Session] configured with a [RetryPolicy].
+type Idempotent interface {
+	Idempotent() bool
+}
+
+func isIdempotent(msg any) bool {
+	i, ok := msg.(Idempotent)
+	return ok && i.Idempotent()
+}
+
+func isRetryable(err error) bool {
+	var richErr RichError
+	if errors.As(err, &richErr) {
+		return richErr.CanRetry
+	}
+	var remoteErr *RemoteError
+	return errors.As(err, &remoteErr) && remoteErr.Retryable
+}
+
+// backoff returns how long to wait after the given (1-indexed) attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	mult := math.Max(p.Multiplier, 1)
+	d := float64(p.InitialBackoff) * math.Pow(mult, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	if d > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,46 @@
+package xpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+
+	assert.Equal(t, 100*time.Millisecond, p.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, p.backoff(2))
+	assert.Equal(t, 400*time.Millisecond, p.backoff(3))
+	assert.Equal(t, 800*time.Millisecond, p.backoff(4))
+	assert.Equal(t, time.Second, p.backoff(5))
+	assert.Equal(t, time.Second, p.backoff(100))
+
+	p.Multiplier = 0
+	assert.Equal(t, 100*time.Millisecond, p.backoff(3))
+}
+
+type idempotentMsg struct{}
+
+func (idempotentMsg) Idempotent() bool { return true }
+
+func TestIsIdempotent(t *testing.T) {
+	assert.True(t, isIdempotent(idempotentMsg{}))
+	assert.False(t, isIdempotent(struct{}{}))
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(RichError{Err: errors.New("interrupted"), CanRetry: true}))
+	assert.True(t, isRetryable(fmt.Errorf("wrapped: %w", RichError{Err: errors.New("interrupted"), CanRetry: true})))
+	assert.False(t, isRetryable(RichError{Err: errors.New("invalid"), CanRetry: false}))
+	assert.True(t, isRetryable(&RemoteError{Code: CodeBusy, Retryable: true}))
+	assert.False(t, isRetryable(&RemoteError{Code: CodeInternal}))
+	assert.False(t, isRetryable(errors.New("foobar")))
+}
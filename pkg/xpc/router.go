@@ -0,0 +1,113 @@
+package xpc
+
+/*
+#include <xpc/xpc.h>
+#cgo CFLAGS: -x objective-c
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// methodKey is the reserved key holding the name of the method called by
+// [Call], and used by [Router] to dispatch messages.
+const methodKey = "_method"
+
+// Router dispatches messages received by a single [Listener] to different
+// handlers, based on the method name passed to [Call]. This lets a service
+// expose multiple operations without registering a Mach service for each of
+// them.
+//
+// Messages calling an unknown method, or sent without a method name, get an
+// error reply.
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]ContextHandler
+}
+
+// NewRouter returns an empty [Router]. Use [Router.Handle] to register
+// handlers, and pass [Router.Serve] as the [Listener] ContextHandler.
+func NewRouter() *Router {
+	return &Router{handlers: map[string]ContextHandler{}}
+}
+
+// Handle registers the handler for the given method. It panics if a handler
+// is already registered for that method, or if method is empty.
+func (r *Router) Handle(method string, h ContextHandler) {
+	if method == "" {
+		panic("xpc: empty method name")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.handlers[method]; ok {
+		panic(fmt.Sprintf("xpc: multiple registrations for method %q", method))
+	}
+	r.handlers[method] = h
+}
+
+// Serve implements [ContextHandler].
+func (r *Router) Serve(ctx context.Context, session *Session, msg unsafe.Pointer) {
+	method := messageMethod(msg)
+	if method == "" {
+		ReplyError(session, msg, Errorf(CodeUnknownMethod, "no method specified"))
+		return
+	}
+
+	r.mu.RLock()
+	h, ok := r.handlers[method]
+	r.mu.RUnlock()
+
+	if !ok {
+		ReplyError(session, msg, Errorf(CodeUnknownMethod, "unknown method %q", method))
+		return
+	}
+	h(ctx, session, msg)
+}
+
+// messageMethod returns the method name stored in msg, or an empty string if
+// there's none.
+func messageMethod(msg unsafe.Pointer) string {
+	ckey := C.CString(methodKey)
+	defer C.free(unsafe.Pointer(ckey))
+
+	cmethod := C.xpc_dictionary_get_string((C.xpc_object_t)(msg), ckey)
+	if cmethod == nil {
+		return ""
+	}
+	return C.GoString(cmethod)
+}
+
+// Call sends a message calling the given method to the session, and waits for
+// a reply. The server should dispatch messages with a [Router]. This should
+// be used by clients exclusively.
+func Call[In any, Out any](s *Session, method string, msg In, opts ...CallOption) (Out, error) {
+	return CallContext[In, Out](context.Background(), s, method, msg, opts...)
+}
+
+// CallContext is like [Call], but with a context. See [SendWaitReplyContext].
+func CallContext[In any, Out any](ctx context.Context, s *Session, method string, msg In, opts ...CallOption) (Out, error) {
+	var out Out
+	if !isStruct(msg) {
+		return out, errors.New("msg must be a struct")
+	}
+
+	payload, err := Marshal(msg)
+	if err != nil {
+		return out, err
+	}
+	defer C.xpc_release(payload)
+
+	ckey := C.CString(methodKey)
+	defer C.free(unsafe.Pointer(ckey))
+	cmethod := C.CString(method)
+	defer C.free(unsafe.Pointer(cmethod))
+	C.xpc_dictionary_set_string(payload, ckey, cmethod)
+
+	return sendWaitReply[Out](ctx, s, payload, isIdempotent(msg), opts)
+}
@@ -0,0 +1,132 @@
+package xpc
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errQueueFull       = errors.New("queue is full")
+	errSchedulerClosed = errors.New("scheduler is closed")
+)
+
+// scheduler distributes items to a pool of workers. Items pushed with the same
+// key are processed in order, one at a time, while items with different keys
+// are processed concurrently.
+type scheduler[K comparable, T any] struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	wg   sync.WaitGroup
+
+	// queues holds the items of every key that has items pending or being
+	// processed.
+	queues map[K]*keyQueue[K, T]
+	// ready holds the queues that have pending items, but aren't held by a
+	// worker.
+	ready []*keyQueue[K, T]
+	// pending is the total number of items waiting to be processed.
+	pending  int
+	maxQueue int
+	closed   bool
+}
+
+type keyQueue[K comparable, T any] struct {
+	key   K
+	items []T
+}
+
+// newScheduler creates a scheduler and starts its workers. maxQueue is the
+// maximum number of pending items, or 0 for no limit.
+func newScheduler[K comparable, T any](workers, maxQueue int, handle func(T)) *scheduler[K, T] {
+	s := &scheduler[K, T]{
+		queues:   map[K]*keyQueue[K, T]{},
+		maxQueue: maxQueue,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	workers = max(workers, 1)
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer s.wg.Done()
+			s.work(handle)
+		}()
+	}
+
+	return s
+}
+
+// push adds item to the queue of key. If the scheduler already has maxQueue
+// pending items, push either waits for room if block is true, or returns
+// errQueueFull. It returns errSchedulerClosed if the scheduler is closed.
+func (s *scheduler[K, T]) push(key K, item T, block bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.maxQueue > 0 && s.pending >= s.maxQueue && !s.closed {
+		if !block {
+			return errQueueFull
+		}
+		s.cond.Wait()
+	}
+	if s.closed {
+		return errSchedulerClosed
+	}
+
+	q, ok := s.queues[key]
+	if !ok {
+		q = &keyQueue[K, T]{key: key}
+		s.queues[key] = q
+		s.ready = append(s.ready, q)
+	}
+	q.items = append(q.items, item)
+	s.pending++
+	s.cond.Broadcast()
+
+	return nil
+}
+
+func (s *scheduler[K, T]) work(handle func(T)) {
+	for {
+		s.mu.Lock()
+		for len(s.ready) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.ready) == 0 {
+			s.mu.Unlock()
+			return
+		}
+
+		q := s.ready[0]
+		s.ready = s.ready[1:]
+		item := q.items[0]
+		q.items = q.items[1:]
+		s.pending--
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		handle(item)
+
+		s.mu.Lock()
+		if len(q.items) > 0 {
+			// Put the queue at the end, so that other keys get a chance to
+			// be processed.
+			s.ready = append(s.ready, q)
+			s.cond.Broadcast()
+		} else {
+			delete(s.queues, q.key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// close stops accepting new items, and waits for the workers to process all
+// the pending ones.
+func (s *scheduler[K, T]) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,82 @@
+package xpc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerOrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]int{}
+
+	s := newScheduler[string](4, 0, func(item [2]int) {
+		key := []string{"a", "b", "c"}[item[0]]
+		mu.Lock()
+		got[key] = append(got[key], item[1])
+		mu.Unlock()
+	})
+
+	for i := 0; i < 100; i++ {
+		for k, key := range []string{"a", "b", "c"} {
+			require.NoError(t, s.push(key, [2]int{k, i}, true))
+		}
+	}
+	s.close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Len(t, got[key], 100)
+		assert.IsIncreasing(t, got[key])
+	}
+}
+
+func TestSchedulerConcurrencyAcrossKeys(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 2)
+
+	s := newScheduler[string](2, 0, func(key string) {
+		started <- key
+		<-release
+	})
+	defer s.close()
+
+	require.NoError(t, s.push("a", "a", true))
+	require.NoError(t, s.push("a", "a", true))
+	require.NoError(t, s.push("b", "b", true))
+
+	// "a" and "b" should start concurrently, but the second "a" should wait
+	// for the first one to finish.
+	assert.ElementsMatch(t, []string{"a", "b"}, []string{<-started, <-started})
+	select {
+	case key := <-started:
+		t.Fatalf("unexpected item %q started", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, "a", <-started)
+}
+
+func TestSchedulerQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	s := newScheduler[string](1, 1, func(int) {
+		started <- struct{}{}
+		<-release
+	})
+
+	require.NoError(t, s.push("a", 1, false))
+	<-started
+	require.NoError(t, s.push("b", 2, false))
+	assert.ErrorIs(t, s.push("c", 3, false), errQueueFull)
+
+	close(release)
+	<-started
+	s.close()
+
+	assert.ErrorIs(t, s.push("d", 4, false), errSchedulerClosed)
+}
@@ -15,8 +15,13 @@ bool is_code_signing_requirement_available() {
 */
 import "C"
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -29,70 +34,407 @@ func IsCodeSigningRequirementAvailable() bool {
 
 // Server is a high-level wrapper around multiple listeners. It will start
 // processing messages for all listeners when calling [Server.Run]. You must
-// call [Server.Close] to stop processing messages and free resources.
+// call [Server.Shutdown] or [Server.Close] to stop processing messages and
+// free resources.
+//
+// Listeners can be added and removed at any time with [Server.AddListener] and
+// [Server.RemoveListener].
 type Server struct {
-	listeners []listener
-	wg        sync.WaitGroup
+	opts ServerOptions
+
+	mu        sync.Mutex
+	listeners map[string]*listener
+	serving   bool
+	// closed is closed when the server is shut down.
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
+// ErrServerClosed is returned when trying to add a listener to a server that
+// is shut down.
+var ErrServerClosed = errors.New("xpc: server closed")
+
 // Listener represents a listener for an XPC service. The service Name must be
 // a Mach service name -- that is, it should be a service managed by launchd.
 // The Requirement string is optional and can be used to specify a code signing
 // requirement. You can check whether the running system supports putting code
 // signing requirements on XPC services by calling [IsCodeSigningRequirementAvailable].
 // The listener will call the Handler function whenever a new message is
-// received.
+// received. Alternatively, ContextHandler can be set instead of Handler to
+// get the context of the message -- only one of them can be set. The
+// Middlewares wrap the handler, in order -- that is, the first one runs
+// first. See [Middleware].
+//
+// By default, messages are handled one at a time. MaxConcurrency can be set to
+// handle messages sent by different peers concurrently. Messages sent by a
+// same peer are always handled in order, one at a time. MaxQueue limits the
+// number of messages waiting to be handled (0 means no limit). When that limit
+// is reached, the listener stops receiving messages until some room is
+// available, unless RejectWhenBusy is set, in which case clients get a "busy"
+// error reply.
+//
+// Handlers have a deadline: once Timeout has elapsed (0 means no timeout), or
+// once the deadline set by the client with [SendWaitReplyContext] or
+// [CallContext] is exceeded, whichever comes first, the context passed to the
+// ContextHandler is cancelled. At that point, the
+// client gets a [CodeDeadlineExceeded] error reply, and later replies from
+// that handler fail with [ErrAlreadyReplied]. The listener still waits for the
+// handler to return before handling the next message from that peer, so
+// handlers should return once their context is done.
+//
+// RateLimit, if set, limits the rate at which each peer can send messages.
+// It's enforced as messages are received, before they're queued. See
+// [RateLimit].
+//
+// Policies restrict which peers can call each method, based on their
+// credentials. Once set, methods without a policy are denied, unless there's
+// a default policy with an empty Method. They're evaluated after the
+// Middlewares, right before the handler, such that middlewares like
+// [AccessLog] see denied messages. See [Policy].
+//
+// OnConnect is called when a new peer sends its first message, before that
+// message is handled -- not as soon as the peer connects, since XPC only
+// tells the identity of a peer through the messages it sends. Here, it's
+// available through [Session.Peer]. OnConnect can reject the peer by
+// returning an error, in which case the client gets a permission error reply
+// and is disconnected. Otherwise, the state it returns is made available to
+// handlers through [Session.State]. OnDisconnect is called with that state
+// once the peer is disconnected and all its messages are handled. Peers that
+// disconnect without sending any message trigger neither hook.
 //
 // To know more about code signing requirements, see the following documentation:
 //
 // [Code Signing Requirement Language](https://developer.apple.com/library/archive/documentation/Security/Conceptual/CodeSigningGuide/RequirementLang/RequirementLang.html)
 // [TN3127: Inside Code Signing: Requirements](https://developer.apple.com/documentation/technotes/tn3127-inside-code-signing-requirements)
 type Listener struct {
-	Name        string
-	Requirement string
-	Handler     Handler
+	Name           string
+	Requirement    string
+	Handler        Handler
+	ContextHandler ContextHandler
+	Middlewares    []Middleware
+
+	MaxConcurrency int
+	MaxQueue       int
+	RejectWhenBusy bool
+	Timeout        time.Duration
+	RateLimit      *RateLimit
+	Policies       []Policy
+
+	OnConnect    func(peer *Session) (state any, err error)
+	OnDisconnect func(peer *Session, state any)
 }
 
+// Handler is called for every message received by a [Listener]. The session
+// is the peer that sent the message, and can be used to [Reply] to it. See
+// [ContextHandler] for handlers that need the context of the message.
 type Handler func(session *Session, msg unsafe.Pointer)
 
-func NewServer(listeners ...Listener) (_ *Server, retErr error) {
-	ls := make([]listener, len(listeners))
-	for i, listener := range listeners {
-		var err error
-		ls[i], err = newListener(listener.Name, listener.Requirement, listener.Handler)
-		if err != nil {
+// ContextHandler is like [Handler], but also gets the context of the message.
+// It carries the message's deadline, its [RequestInfo] and its trace context.
+// See [HandleFunc] for a higher-level way to write handlers.
+type ContextHandler func(ctx context.Context, session *Session, msg unsafe.Pointer)
+
+// withContext adapts h to a [ContextHandler], ignoring the context.
+func (h Handler) withContext() ContextHandler {
+	return func(_ context.Context, session *Session, msg unsafe.Pointer) {
+		h(session, msg)
+	}
+}
+
+// ServerOptions holds optional settings for a [Server]. See
+// [NewServerWithOptions].
+type ServerOptions struct {
+	// PanicHandler is called when a handler panics. The panic is recovered
+	// regardless, and the client gets an internal error reply. If nil, the
+	// panic and its stack trace are logged with the standard logger.
+	PanicHandler PanicHandler
+	// Middlewares wrap the handler of every [Listener]. They run before the
+	// Middlewares set on the Listener itself.
+	Middlewares []Middleware
+	// ShutdownTimeout is how long [ListenAndServe] waits for in-flight
+	// handlers to finish when stopping the server. Defaults to
+	// [DefaultShutdownTimeout].
+	ShutdownTimeout time.Duration
+	// Tracer, if set, starts a span for every message handled, as a child of
+	// the span propagated by the client. See [SessionOptions.Tracer].
+	Tracer Tracer
+	// Metrics, if set, receives events from all the listeners. See [Metrics].
+	Metrics Metrics
+	// OnPolicyDenied, if set, is called whenever a message is rejected by
+	// one of the [Policy] of a listener -- for instance, to audit denials.
+	OnPolicyDenied func(ctx context.Context, denial PolicyDenial)
+	// Audit, if set, records every request received by the listeners --
+	// including the ones rejected before reaching their handler, and the
+	// ones dropped because their peer was rejected by OnConnect. The
+	// only requests not recorded are the ones received while a listener is
+	// shutting down, and the ones dropped while it's flooded with requests
+	// it rejects for being rate-limited or busy, past 64 concurrent
+	// rejections. See [AuditOptions].
+	Audit *AuditOptions
+}
+
+// DefaultShutdownTimeout is the default value of
+// [ServerOptions.ShutdownTimeout].
+const DefaultShutdownTimeout = 10 * time.Second
+
+// PanicHandler is called when a handler panics.
+type PanicHandler func(ctx context.Context, info PanicInfo)
+
+// PanicInfo describes a panic recovered from a handler.
+type PanicInfo struct {
+	// Service is the name of the [Listener] that received the message.
+	Service string
+	// Session is the peer that sent the message.
+	Session *Session
+	// Value is the value passed to panic.
+	Value any
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func NewServer(listeners ...Listener) (*Server, error) {
+	return NewServerWithOptions(ServerOptions{}, listeners...)
+}
+
+// NewServerWithOptions is like [NewServer] but lets the caller specify
+// additional [ServerOptions].
+func NewServerWithOptions(opts ServerOptions, listeners ...Listener) (_ *Server, retErr error) {
+	s := &Server{
+		opts:      opts,
+		listeners: make(map[string]*listener, len(listeners)),
+		closed:    make(chan struct{}),
+	}
+	defer func() {
+		if retErr != nil {
+			s.Close()
+		}
+	}()
+
+	for _, listener := range listeners {
+		if err := s.AddListener(listener); err != nil {
 			return nil, err
 		}
+	}
 
-		defer func() {
-			if retErr != nil {
-				ls[i].Close()
-			}
-		}()
+	return s, nil
+}
+
+// AddListener creates a new listener and adds it to the server. If the server
+// is already serving, the listener immediately starts processing messages.
+// It returns an error if the server already has a listener with the same
+// name.
+func (s *Server) AddListener(cfg Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return ErrServerClosed
+	default:
+	}
+
+	if _, ok := s.listeners[cfg.Name]; ok {
+		return fmt.Errorf("listener %s already exists", cfg.Name)
+	}
+
+	l, err := newListener(cfg, s.opts)
+	if err != nil {
+		return err
+	}
+	s.listeners[cfg.Name] = l
+
+	if s.serving {
+		s.start(l)
+	}
+	return nil
+}
+
+// RemoveListener stops the listener with the given name, and removes it from
+// the server. In-flight handlers are given up to
+// [ServerOptions.ShutdownTimeout] to finish, like in [ListenAndServe]. It
+// returns an error if the server has no listener with that name.
+func (s *Server) RemoveListener(name string) error {
+	s.mu.Lock()
+	l, ok := s.listeners[name]
+	delete(s.listeners, name)
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("listener %s does not exist", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+
+	return l.shutdown(ctx)
+}
+
+// Peers returns the sessions of all the peers connected to the listener with
+// the given name, and accepted by its OnConnect hook. It returns nil if
+// the server has no such listener. Peers that didn't send any message yet
+// aren't returned.
+//
+// The sessions can be kept and used to send messages to the peers with [Send]
+// or [SendWaitReply] until they disconnect, at which point these return
+// [ErrPeerDisconnected].
+func (s *Server) Peers(listenerName string) []*Session {
+	s.mu.Lock()
+	l, ok := s.listeners[listenerName]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
 	}
+	return l.connectedPeers()
+}
 
-	return &Server{
-		listeners: ls,
-		wg:        sync.WaitGroup{},
-	}, nil
+// Broadcast sends msg to all the peers connected to the listener with the
+// given name. See [Server.Peers]. Peers disconnecting in the meantime are
+// ignored.
+func Broadcast[T any](s *Server, listenerName string, msg T) error {
+	var errs []error
+	for _, peer := range s.Peers(listenerName) {
+		if err := Send(peer, msg); err != nil && !errors.Is(err, ErrPeerDisconnected) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// Run processes messages for all listeners until the server is stopped. See
+// [Server.Serve] for a version that can be interrupted.
 func (s *Server) Run() {
-	for _, listener := range s.listeners {
-		listener := listener
-		s.wg.Add(1)
+	s.Serve(context.Background())
+}
+
+// Serve processes messages for all listeners, including the ones added later
+// through [Server.AddListener]. It blocks until the server is stopped by
+// [Server.Shutdown] or [Server.Close], in which case it returns nil, or until
+// ctx is done, in which case it returns ctx's error.
+//
+// Note that when ctx is done, listeners keep processing messages -- the caller
+// should then call [Server.Shutdown] to gracefully stop the server. See
+// [ListenAndServe] for a helper doing that on SIGTERM and SIGINT.
+func (s *Server) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	if s.serving {
+		s.mu.Unlock()
+		return errors.New("server is already serving")
+	}
+	s.serving = true
+	for _, l := range s.listeners {
+		s.start(l)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start runs l in a new goroutine. s.mu must be held, such that l can't be
+// drained before it's started.
+func (s *Server) start(l *listener) {
+	l.running.Add(1)
+	go l.run()
+}
+
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.opts.ShutdownTimeout == 0 {
+		return DefaultShutdownTimeout
+	}
+	return s.opts.ShutdownTimeout
+}
+
+// ListenAndServe creates a [Server] and processes messages for all listeners
+// until the process receives SIGTERM or SIGINT -- for instance, when launchd
+// stops the daemon. The server is then gracefully shut down, giving in-flight
+// handlers up to [ServerOptions.ShutdownTimeout] to finish.
+func ListenAndServe(opts ServerOptions, listeners ...Listener) error {
+	srv, err := NewServerWithOptions(opts, listeners...)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	serveErr := srv.Serve(ctx)
+	if errors.Is(serveErr, context.Canceled) {
+		serveErr = nil
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), srv.shutdownTimeout())
+	defer cancel()
+
+	return errors.Join(serveErr, srv.Shutdown(shutdownCtx))
+}
+
+// Shutdown gracefully stops the server. Listeners stop accepting new peers and
+// messages, and in-flight handlers are given until ctx is done to finish. If
+// they don't, their context is cancelled and ctx's error is returned. In all
+// cases, peers are disconnected and resources are released once all handlers
+// have returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	listeners := s.stop()
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Add(1)
 		go func() {
-			defer s.wg.Done()
-			listener.run()
+			defer wg.Done()
+			errs[i] = listener.shutdown(ctx)
 		}()
 	}
-	s.wg.Wait()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Close immediately stops the server. Unlike [Server.Shutdown], it doesn't
+// give in-flight handlers time to finish -- their context is cancelled right
+// away. It still waits for them to return, so handlers must honor the
+// cancellation of their context, and all resources are released when Close
+// returns.
 func (s *Server) Close() error {
-	errs := make([]error, 0, len(s.listeners))
-	for _, listener := range s.listeners {
-		errs = append(errs, listener.Close())
+	listeners := s.stop()
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = listener.Close()
+		}()
 	}
+	wg.Wait()
 	return errors.Join(errs...)
 }
+
+// stop marks the server as closed, and removes all its listeners. It returns
+// the listeners removed.
+func (s *Server) stop() []*listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+
+	listeners := make([]*listener, 0, len(s.listeners))
+	for name, l := range s.listeners {
+		listeners = append(listeners, l)
+		delete(s.listeners, name)
+	}
+	return listeners
+}
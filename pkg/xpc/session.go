@@ -7,37 +7,145 @@ package xpc
 */
 import "C"
 import (
+	"context"
 	"errors"
+	"fmt"
 	"reflect"
+	"runtime/cgo"
+	"sync"
+	"time"
 	"unsafe"
 )
 
 type Session struct {
+	mu   sync.Mutex
 	sess unsafe.Pointer
 	q    unsafe.Pointer
+
+	// service and opts are only set for client sessions. They're used to
+	// re-create the underlying XPC session when needed. handle is only set if
+	// opts has a Handler.
+	service string
+	opts    SessionOptions
+	handle  cgo.Handle
+
+	// peer and req are only set for server-side sessions. req is only set
+	// for sessions passed to a [Handler].
+	peer *peerConn
+	req  *RequestInfo
+}
+
+// ErrSessionClosed is returned when sending a message through a closed
+// session.
+var ErrSessionClosed = errors.New("xpc: session closed")
+
+// ErrAlreadyReplied is returned when replying to a message that was already
+// replied to -- for instance, when a handler replies after its deadline.
+var ErrAlreadyReplied = errors.New("xpc: message already replied")
+
+// SessionOptions holds optional settings for client sessions. See
+// [NewSessionWithOptions].
+type SessionOptions struct {
+	// Retry is the policy used to recover from retryable errors. If nil,
+	// errors are returned as is to the caller, and the session isn't
+	// re-created.
+	Retry *RetryPolicy
+	// PeerRequirement is an optional code signing requirement that the
+	// service must satisfy. It lets clients authenticate the service they're
+	// talking to, and refuse to send messages to an impostor that registered
+	// the same Mach service name. See [Listener] for the requirement
+	// language, and [IsCodeSigningRequirementAvailable] to check whether the
+	// running system supports it.
+	//
+	// XPC won't deliver messages to a peer that doesn't satisfy the
+	// requirement. Additionally, replies received by [SendWaitReply] are
+	// checked against it. In both cases, the error returned wraps
+	// [ErrRequirementNotSatisfied].
+	PeerRequirement string
+	// Handler is called for every message sent by the service with [Send] --
+	// for instance, when the service broadcasts a notification to all its
+	// peers. It might be called concurrently. If nil, such messages are
+	// dropped.
+	Handler ContextHandler
+	// Tracer, if set, propagates the trace context of the span carried by the
+	// context passed to [SendContext], [SendWaitReplyContext] and
+	// [CallContext].
+	Tracer Tracer
+	// Metrics, if set, receives the latency of the calls made through the
+	// session, and reply decoding errors.
+	Metrics Metrics
 }
 
 // NewSession opens a new session with the given XPC service. This service
 // must be a Mach service name -- that is, it should be a service managed by
 // launchd. You need to [Close] the session when you're done with it.
 func NewSession(service string) (*Session, error) {
-	cname := C.CString(service)
+	return NewSessionWithOptions(service, SessionOptions{})
+}
+
+// NewSessionWithOptions is like [NewSession] but lets the caller specify
+// additional [SessionOptions].
+func NewSessionWithOptions(service string, opts SessionOptions) (*Session, error) {
+	s := &Session{
+		service: service,
+		opts:    opts,
+	}
+	if opts.Handler != nil {
+		s.handle = cgo.NewHandle(s)
+	}
+
+	var err error
+	if s.sess, s.q, err = s.dial(); err != nil {
+		if s.handle != 0 {
+			s.handle.Delete()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) dial() (sess, q unsafe.Pointer, _ error) {
+	cname := C.CString(s.service)
 	defer C.free(unsafe.Pointer(cname))
 
-	res := C.new_session(cname)
-	if res.err != nil {
+	var crequirement *C.char
+	if s.opts.PeerRequirement != "" {
+		crequirement = C.CString(s.opts.PeerRequirement)
+		defer C.free(unsafe.Pointer(crequirement))
+	}
+
+	res := C.new_session(cname, crequirement, C.uintptr_t(s.handle))
+	switch res.err_code {
+	case 0:
+		// No errors
+	case C.XPC_SESSION_CREATE_FAILED:
+		defer C.xpc_release((C.xpc_object_t)(res.err))
+		return nil, nil, newRichError(unsafe.Pointer(res.err))
+	case C.XPC_SESSION_SET_PEER_CODE_SIGNING_REQUIREMENT_FAILED:
+		defer C.xpc_release((C.xpc_object_t)(res.err))
+		return nil, nil, fmt.Errorf("failed to set peer code signing requirement: %w", newRichError(unsafe.Pointer(res.err)))
+	case C.XPC_SESSION_ACTIVATE_FAILED:
 		defer C.xpc_release((C.xpc_object_t)(res.err))
-		return nil, newRichError(unsafe.Pointer(res.err))
+		return nil, nil, fmt.Errorf("failed to activate session: %w", requirementError(newRichError(unsafe.Pointer(res.err))))
+	default:
+		return nil, nil, fmt.Errorf("unknown error code: %d", res.err_code)
 	}
-	return &Session{
-		sess: unsafe.Pointer(res.session),
-		q:    unsafe.Pointer(res.queue),
-	}, nil
+	return unsafe.Pointer(res.session), unsafe.Pointer(res.queue), nil
 }
 
-// Send sends a message to the session without waiting for a reply. This should
-// be used by clients exclusively. See [Reply] for the server side.
-func Send[In any](s *Session, msg In) error {
+// Send sends a message to the session without waiting for a reply. Clients use
+// it to send messages to a service. Servers can also use it to send messages
+// to a peer outside of a [Handler] -- for instance, with a session returned by
+// [Server.Peers]. See [Reply] to reply to a message.
+func Send[In any](s *Session, msg In, opts ...CallOption) error {
+	return SendContext(context.Background(), s, msg, opts...)
+}
+
+// SendContext is like [Send], but the deadline of ctx, if any, is sent along
+// with the message, and bounds the context passed to the server's
+// [ContextHandler].
+// It also stops retrying once ctx is done.
+func SendContext[In any](ctx context.Context, s *Session, msg In, opts ...CallOption) (err error) {
 	// Despite xpc_session_send_message's 2nd argument being an xpc_object_t,
 	// it actually expect an XPC dictionary. [marshal] doesn't support maps, so
 	// just check if msg is a struct.
@@ -52,38 +160,75 @@ func Send[In any](s *Session, msg In) error {
 	}
 	// TODO(aker): do we need to walk the payload to free all the objects?
 	defer C.xpc_release(payload)
+	s.prepare(ctx, payload, opts)
 
-	xpcErr := C.xpc_session_send_message((C.xpc_session_t)(s.sess), payload)
-	if xpcErr != nil {
-		defer C.xpc_release(xpcErr)
-		return newRichError(unsafe.Pointer(xpcErr))
-	}
+	start := time.Now()
+	defer func() { s.metrics().ClientCall(s.service, time.Since(start), err) }()
 
-	return nil
+	return s.withRetry(ctx, isIdempotent(msg), func(sess C.xpc_session_t) error {
+		xpcErr := C.xpc_session_send_message(sess, payload)
+		if xpcErr != nil {
+			defer C.xpc_release(xpcErr)
+			return newRichError(unsafe.Pointer(xpcErr))
+		}
+		return nil
+	})
 }
 
+// Reply sends msg as the reply to the original message. If original was sent
+// with [Send], and thus doesn't expect a reply, nothing is sent.
 func Reply[Out any](s *Session, original unsafe.Pointer, msg Out) error {
 	if !isStruct(msg) {
 		return errors.New("msg must be a struct")
 	}
 
 	payload := C.xpc_dictionary_create_reply((C.xpc_object_t)(original))
+	if payload == nil {
+		return nil
+	}
+	defer C.xpc_release(payload)
 	if err := marshalIntoDict(payload, msg); err != nil {
 		return err
 	}
 
+	return s.sendReply(payload, "")
+}
+
+// sendReply sends payload, a reply to the message being handled. errorCode
+// is the code of the error being replied, if any. It returns
+// [ErrAlreadyReplied] if that message was already replied.
+func (s *Session) sendReply(payload C.xpc_object_t, errorCode ErrorCode) (err error) {
+	if !s.req.beginReply() {
+		return ErrAlreadyReplied
+	}
+	defer func() { s.req.endReply(errorCode, err) }()
+
 	xpcErr := C.xpc_session_send_message((C.xpc_session_t)(s.sess), payload)
 	if xpcErr != nil {
 		defer C.xpc_release(xpcErr)
 		return newRichError(unsafe.Pointer(xpcErr))
 	}
 
+	// Computing the size of the reply means walking through it, so don't do
+	// it if nobody cares.
+	if m := s.req.serverMetrics(); m != nil {
+		m.ReplySent(s.req.Service, objectSize(payload))
+	}
 	return nil
 }
 
-// SendWaitReply sends a message to the session and waits for a reply. This
-// should be used by clients exclusively. See [Reply] for the server side.
-func SendWaitReply[In any, Out any](s *Session, msg In) (Out, error) {
+// SendWaitReply sends a message to the session and waits for a reply. See
+// [Reply] for the other side. If the peer replies with [ReplyError], a
+// [*RemoteError] is returned.
+func SendWaitReply[In any, Out any](s *Session, msg In, opts ...CallOption) (Out, error) {
+	return SendWaitReplyContext[In, Out](context.Background(), s, msg, opts...)
+}
+
+// SendWaitReplyContext is like [SendWaitReply], but the deadline of ctx, if
+// any, is sent along with the message, and bounds the context passed to the
+// server's [ContextHandler]. It stops waiting for the reply, and returns ctx.Err(),
+// once ctx is done.
+func SendWaitReplyContext[In any, Out any](ctx context.Context, s *Session, msg In, opts ...CallOption) (Out, error) {
 	var out Out
 	// Despite xpc_session_send_message_with_reply_sync's 2nd argument being
 	// an xpc_object_t, it actually expect an XPC dictionary. [marshal] doesn't
@@ -99,32 +244,272 @@ func SendWaitReply[In any, Out any](s *Session, msg In) (Out, error) {
 	}
 	defer C.xpc_release(payload)
 
-	res := C.send_message_with_reply((C.xpc_session_t)(s.sess), payload)
-	if res.err != nil {
-		defer C.xpc_release(res.err)
-		return out, newRichError(unsafe.Pointer(res.err))
+	return sendWaitReply[Out](ctx, s, payload, isIdempotent(msg), opts)
+}
+
+func sendWaitReply[Out any](ctx context.Context, s *Session, payload C.xpc_object_t, idempotent bool, opts []CallOption) (out Out, err error) {
+	var reply C.xpc_object_t
+	s.prepare(ctx, payload, opts)
+
+	start := time.Now()
+	defer func() { s.metrics().ClientCall(s.service, time.Since(start), err) }()
+
+	err = s.withRetry(ctx, idempotent, func(sess C.xpc_session_t) error {
+		res, err := sendMessageWithReply(ctx, sess, payload)
+		if err != nil {
+			return err
+		}
+
+		if s.opts.PeerRequirement != "" {
+			if err := peerInfoFromMessage(res).CheckRequirement(s.opts.PeerRequirement); err != nil {
+				C.xpc_release((C.xpc_object_t)(res))
+				return err
+			}
+		}
+		if remoteErr := decodeErrorReply(res); remoteErr != nil {
+			C.xpc_release((C.xpc_object_t)(res))
+			return remoteErr
+		}
+
+		reply = (C.xpc_object_t)(res)
+		return nil
+	})
+	if err != nil {
+		return out, err
 	}
-	defer C.xpc_release(res.reply)
+	defer C.xpc_release(reply)
 
-	if err := Unmarshal(unsafe.Pointer(res.reply), &out); err != nil {
+	if err := Unmarshal(unsafe.Pointer(reply), &out); err != nil {
+		s.metrics().DecodeError(s.service)
 		return out, err
 	}
 
 	return out, nil
 }
 
+func (s *Session) metrics() Metrics {
+	if s.opts.Metrics == nil {
+		return NopMetrics{}
+	}
+	return s.opts.Metrics
+}
+
+// CallOption configures a single message sent by a client, with [Send],
+// [SendWaitReply], [Call] or their variants. See [WithMetadata].
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	metadata Metadata
+}
+
+func newCallOptions(opts []CallOption) callOptions {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// apply stores the options that travel with the message into payload.
+func (o callOptions) apply(payload C.xpc_object_t) {
+	setMetadata(payload, o.metadata)
+}
+
+// prepare stores the data traveling alongside the message into payload: the
+// deadline and trace context of ctx, and opts.
+func (s *Session) prepare(ctx context.Context, payload C.xpc_object_t, opts []CallOption) {
+	setDeadline(ctx, payload)
+	newCallOptions(opts).apply(payload)
+
+	if s.opts.Tracer != nil {
+		carrier := TraceCarrier{}
+		s.opts.Tracer.Inject(ctx, carrier)
+		setStringDict(payload, traceContextKey, carrier)
+	}
+}
+
+// replyResult is the outcome of an asynchronous send, passed by on_reply.
+type replyResult struct {
+	reply unsafe.Pointer
+	err   error
+}
+
+// sendMessageWithReply sends payload and waits for its reply, or for ctx to
+// be done. The reply must be released by the caller.
+func sendMessageWithReply(ctx context.Context, sess C.xpc_session_t, payload C.xpc_object_t) (unsafe.Pointer, error) {
+	// Buffered, such that on_reply never blocks the session's queue.
+	ch := make(chan replyResult, 1)
+	h := cgo.NewHandle(ch)
+	C.send_message_with_reply(sess, payload, C.uintptr_t(h))
+
+	select {
+	case res := <-ch:
+		h.Delete()
+		return res.reply, res.err
+	case <-ctx.Done():
+		// XPC always calls the reply handler -- with an error if the session
+		// is cancelled -- so the handle can be deleted and the late reply
+		// released once it's there.
+		go func() {
+			res := <-ch
+			h.Delete()
+			if res.reply != nil {
+				C.xpc_release((C.xpc_object_t)(res.reply))
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+//export on_reply
+func on_reply(h C.uintptr_t, reply C.xpc_object_t, richErr C.xpc_rich_error_t) {
+	ch := cgo.Handle(h).Value().(chan replyResult)
+	if richErr != nil {
+		ch <- replyResult{err: newRichError(unsafe.Pointer(richErr))}
+		return
+	}
+	// The reply is released once the reply handler returns.
+	C.xpc_retain(reply)
+	ch <- replyResult{reply: unsafe.Pointer(reply)}
+}
+
+// isStruct reports whether v is a struct, and thus is marshaled as a
+// dictionary. An [Object] is only if it holds a dictionary.
 func isStruct(v any) bool {
+	if o, ok := v.(Object); ok {
+		return o.isDictionary()
+	}
 	return reflect.TypeOf(v).Kind() == reflect.Struct
 }
 
+// withRetry calls send with the current XPC session. If it fails with a
+// retryable error and the session has a [RetryPolicy], the XPC session is
+// re-created, and send is called again if the message is idempotent.
+func (s *Session) withRetry(ctx context.Context, idempotent bool, send func(sess C.xpc_session_t) error) error {
+	if s.peer != nil {
+		return s.peer.do(send)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if again, err := s.try(ctx, attempt, idempotent, send); !again {
+			return err
+		}
+	}
+}
+
+// try makes one attempt of [Session.withRetry]. It returns whether send should
+// be called again.
+func (s *Session) try(ctx context.Context, attempt int, idempotent bool, send func(sess C.xpc_session_t) error) (again bool, _ error) {
+	sess := s.current()
+	if sess == nil {
+		return false, ErrSessionClosed
+	}
+	// Only release sess once it's not used anymore, including by reconnect,
+	// such that its address can't be reused by a new session in the meantime.
+	defer C.xpc_release((C.xpc_object_t)(sess))
+
+	err := send((C.xpc_session_t)(sess))
+	if s.opts.PeerRequirement != "" {
+		err = requirementError(err)
+	}
+	if err == nil || s.opts.Retry == nil || !isRetryable(err) {
+		return false, err
+	}
+
+	if idempotent && attempt < s.opts.Retry.MaxAttempts {
+		select {
+		case <-time.After(s.opts.Retry.backoff(attempt)):
+		case <-ctx.Done():
+			return false, errors.Join(err, ctx.Err())
+		}
+	}
+	// Only re-create the session if the failure comes from XPC itself,
+	// not if the peer replied with a retryable error.
+	var richErr RichError
+	if errors.As(err, &richErr) {
+		if reconnErr := s.reconnect(sess); reconnErr != nil {
+			return false, errors.Join(err, reconnErr)
+		}
+	}
+	return idempotent && attempt < s.opts.Retry.MaxAttempts, err
+}
+
+// current returns the current XPC session, or nil if the session is closed.
+// It's retained, such that it stays valid even if another goroutine
+// reconnects or closes the session in the meantime, and must be released by
+// the caller.
+func (s *Session) current() unsafe.Pointer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sess != nil {
+		C.xpc_retain((C.xpc_object_t)(s.sess))
+	}
+	return s.sess
+}
+
+// reconnect replaces the XPC session old with a new one, unless another
+// goroutine already did it.
+func (s *Session) reconnect(old unsafe.Pointer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sess != old {
+		return nil
+	}
+	if s.service == "" {
+		return errors.New("cannot reconnect a peer session")
+	}
+
+	sess, q, err := s.dial()
+	if err != nil {
+		return err
+	}
+	release(s.sess, s.q)
+	s.sess, s.q = sess, q
+	return nil
+}
+
 // Close closes the session and releases all associated resources. You must
-// call this when you're done with the session.
+// call this when you're done with a client session.
+//
+// On the server side, Close disconnects the peer.
 func (s *Session) Close() {
-	if s.sess == nil {
+	if s.peer != nil {
+		s.peer.do(func(sess C.xpc_session_t) error {
+			C.xpc_session_cancel(sess)
+			return nil
+		})
+		return
+	}
+
+	s.mu.Lock()
+	sess, q := s.sess, s.q
+	s.sess, s.q = nil, nil
+	s.mu.Unlock()
+
+	if sess == nil {
 		return
 	}
 
-	C.xpc_session_cancel((C.xpc_session_t)(s.sess))
-	C.xpc_release((C.xpc_object_t)(s.sess))
-	C.dispatch_release((C.dispatch_queue_t)(s.q))
+	C.xpc_session_cancel((C.xpc_session_t)(sess))
+	if s.handle != 0 {
+		// Wait for the Handler to return before deleting the handle it uses.
+		C.drain_queue((C.dispatch_queue_t)(q))
+		s.handle.Delete()
+	}
+	release(sess, q)
+}
+
+//export on_session_msg_recv
+func on_session_msg_recv(h C.uintptr_t, msg C.xpc_object_t) {
+	s := cgo.Handle(h).Value().(*Session)
+	s.opts.Handler(context.Background(), s, unsafe.Pointer(msg))
+}
+
+func release(sess, q unsafe.Pointer) {
+	C.xpc_session_cancel((C.xpc_session_t)(sess))
+	C.xpc_release((C.xpc_object_t)(sess))
+	if q != nil {
+		C.dispatch_release((C.dispatch_queue_t)(q))
+	}
 }
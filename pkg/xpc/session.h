@@ -1,16 +1,24 @@
 #import <xpc/xpc.h>
+#import "queue.h"
+
+#define XPC_SESSION_CREATE_FAILED -1
+#define XPC_SESSION_SET_PEER_CODE_SIGNING_REQUIREMENT_FAILED -2
+#define XPC_SESSION_ACTIVATE_FAILED -3
 
 typedef struct new_session_res_t {
     xpc_session_t session;
 	dispatch_queue_t queue;
     xpc_rich_error_t err;
+	int err_code;
 } new_session_res_t;
 
-new_session_res_t new_session(const char *service);
+// new_session creates a session with the given Mach service. If opaque isn't
+// 0, messages sent by the service are passed to on_session_msg_recv.
+new_session_res_t new_session(const char *service, const char *requirement, uintptr_t opaque);
 
-typedef struct send_reply_t {
-	xpc_object_t reply;
-	xpc_rich_error_t err;
-} send_reply_t;
+// send_message_with_reply sends payload, and passes its reply, or the error
+// that prevented receiving it, to on_reply.
+void send_message_with_reply(xpc_session_t session, xpc_object_t payload, uintptr_t opaque);
 
-send_reply_t send_message_with_reply(xpc_session_t session, xpc_object_t payload);
+extern void on_session_msg_recv(uintptr_t opaque, xpc_object_t msg);
+extern void on_reply(uintptr_t opaque, xpc_object_t reply, xpc_rich_error_t err);
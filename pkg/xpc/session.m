@@ -1,33 +1,64 @@
 #import "session.h"
 
-new_session_res_t new_session(const char *service) {
+new_session_res_t new_session(const char *service, const char *requirement, uintptr_t opaque) {
 	xpc_rich_error_t error;
 	dispatch_queue_t queue = dispatch_queue_create(service, DISPATCH_QUEUE_CONCURRENT);
 
-	xpc_session_t session = xpc_session_create_mach_service(service, queue, XPC_SESSION_CREATE_MACH_PRIVILEGED, &error);
+	xpc_session_t session = xpc_session_create_mach_service(
+		service,
+		queue,
+		// The session needs to be inactive until the peer code signing
+		// requirement is set, otherwise messages could be sent to an impostor
+		// before we have a chance to check it.
+		XPC_SESSION_CREATE_MACH_PRIVILEGED | XPC_SESSION_CREATE_INACTIVE,
+		&error);
 	if (session == NULL) {
+		dispatch_release(queue);
 		return (new_session_res_t){
 			.err = error,
+			.err_code = XPC_SESSION_CREATE_FAILED,
 		};
 	}
 
-	return (new_session_res_t){
-		.session = session,
-		.queue = queue,
-	};
-}
+	if (requirement != NULL) {
+		error = xpc_session_set_peer_code_signing_requirement(session, requirement);
+		if (error != NULL) {
+			xpc_session_cancel(session);
+			xpc_release((xpc_object_t)session);
+			dispatch_release(queue);
 
-send_reply_t send_message_with_reply(xpc_session_t session, xpc_object_t payload) {
-	xpc_rich_error_t error;
+			return (new_session_res_t){
+				.err = error,
+				.err_code = XPC_SESSION_SET_PEER_CODE_SIGNING_REQUIREMENT_FAILED,
+			};
+		}
+	}
+
+	if (opaque != 0) {
+		xpc_session_set_incoming_message_handler(session, ^(xpc_object_t _Nonnull message) {
+			on_session_msg_recv(opaque, message);
+		});
+	}
+
+	if (!xpc_session_activate(session, &error)) {
+		xpc_session_cancel(session);
+		xpc_release((xpc_object_t)session);
+		dispatch_release(queue);
 
-	xpc_object_t reply = xpc_session_send_message_with_reply_sync(session, payload, &error);
-	if (reply == NULL) {
-		return (send_reply_t){
+		return (new_session_res_t){
 			.err = error,
+			.err_code = XPC_SESSION_ACTIVATE_FAILED,
 		};
 	}
 
-	return (send_reply_t){
-		.reply = reply,
+	return (new_session_res_t){
+		.session = session,
+		.queue = queue,
 	};
 }
+
+void send_message_with_reply(xpc_session_t session, xpc_object_t payload, uintptr_t opaque) {
+	xpc_session_send_message_with_reply_async(session, payload, ^(xpc_object_t _Nullable reply, xpc_rich_error_t _Nullable error) {
+		on_reply(opaque, reply, error);
+	});
+}
@@ -0,0 +1,294 @@
+package xpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// traceContextKey is the reserved key under which the trace context of the
+// client's span is sent, as an XPC dictionary of strings.
+const traceContextKey = "_trace"
+
+// TraceCarrier holds the trace context propagated along with a message. With
+// W3C Trace Context, it holds the "traceparent" and "tracestate" entries.
+//
+// It satisfies OpenTelemetry's propagation.TextMapCarrier interface, such that
+// a [Tracer] can be implemented with any OpenTelemetry propagator.
+type TraceCarrier map[string]string
+
+// Get returns the value associated with key, or an empty string.
+func (c TraceCarrier) Get(key string) string {
+	return c[key]
+}
+
+// Set stores value under key.
+func (c TraceCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys returns the keys stored in the carrier, sorted.
+func (c TraceCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Tracer propagates trace context over XPC. It's set with
+// [SessionOptions.Tracer] on clients, and [ServerOptions.Tracer] on servers.
+// This package doesn't depend on any tracing library; an OpenTelemetry-based
+// Tracer is a thin wrapper around a propagator and a trace.Tracer.
+// [W3CTracer] propagates W3C Trace Context without recording spans.
+type Tracer interface {
+	// Inject stores the trace context of the span carried by ctx, if any,
+	// into carrier. It's called by clients for every message sent with a
+	// context, like with [SendContext] or [CallContext].
+	Inject(ctx context.Context, carrier TraceCarrier)
+	// Start starts the span of the message described by info, as a child of
+	// the span described by carrier -- which is empty if the client didn't
+	// send any trace context. The returned context, carrying the new span, is
+	// passed to the [ContextHandler]. end is called once the handler returns, with
+	// the code of the error it replied, if any.
+	Start(ctx context.Context, carrier TraceCarrier, info *RequestInfo) (_ context.Context, end func(code ErrorCode))
+}
+
+// W3C Trace Context entries, see https://www.w3.org/TR/trace-context/.
+const (
+	traceParentKey = "traceparent"
+	traceStateKey  = "tracestate"
+
+	// maxTraceStateMembers is the maximum number of list-members allowed in
+	// a tracestate entry.
+	maxTraceStateMembers = 32
+)
+
+// TraceContext is the W3C Trace Context of a span: the IDs of its trace and of
+// the span itself, its trace flags, and the vendor-specific tracestate.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	// State is the tracestate entry, as a comma-separated list of key=value
+	// list-members. It's empty if there's none.
+	State string
+}
+
+// IsValid reports whether tc has a non-zero trace ID and span ID.
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the sampled trace flag is set.
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&0x01 != 0
+}
+
+// TraceParent returns the traceparent entry of tc, using version 00.
+func (tc TraceContext) TraceParent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+// Inject stores tc into carrier, as traceparent and tracestate entries. It
+// does nothing if tc isn't valid.
+func (tc TraceContext) Inject(carrier TraceCarrier) {
+	if !tc.IsValid() {
+		return
+	}
+	carrier.Set(traceParentKey, tc.TraceParent())
+	if tc.State != "" {
+		carrier.Set(traceStateKey, tc.State)
+	}
+}
+
+// ExtractTraceContext returns the trace context stored in carrier. It returns
+// an error if carrier has no valid traceparent entry. An invalid tracestate
+// entry is discarded, as allowed by the spec.
+func ExtractTraceContext(carrier TraceCarrier) (TraceContext, error) {
+	tc, err := ParseTraceParent(carrier.Get(traceParentKey))
+	if err != nil {
+		return TraceContext{}, err
+	}
+	if state, err := ParseTraceState(carrier.Get(traceStateKey)); err == nil {
+		tc.State = state
+	}
+	return tc, nil
+}
+
+// ParseTraceParent parses a traceparent entry. Versions newer than 00 are
+// parsed as version 00, ignoring any trailing fields, as required by the spec.
+func ParseTraceParent(s string) (TraceContext, error) {
+	var tc TraceContext
+	if len(s) < 55 {
+		return tc, fmt.Errorf("invalid traceparent %q: too short", s)
+	}
+
+	var version [1]byte
+	if !decodeLowerHex(version[:], s[0:2]) || s[2] != '-' {
+		return tc, fmt.Errorf("invalid traceparent %q: bad version", s)
+	}
+	switch {
+	case version[0] == 0xff:
+		return tc, fmt.Errorf("invalid traceparent %q: version ff is forbidden", s)
+	case version[0] == 0 && len(s) != 55:
+		return tc, fmt.Errorf("invalid traceparent %q: bad length", s)
+	case len(s) > 55 && s[55] != '-':
+		return tc, fmt.Errorf("invalid traceparent %q: bad trailing data", s)
+	}
+
+	var flags [1]byte
+	if !decodeLowerHex(tc.TraceID[:], s[3:35]) || s[35] != '-' ||
+		!decodeLowerHex(tc.SpanID[:], s[36:52]) || s[52] != '-' ||
+		!decodeLowerHex(flags[:], s[53:55]) {
+		return TraceContext{}, fmt.Errorf("invalid traceparent %q: bad field", s)
+	}
+	tc.Flags = flags[0]
+
+	if !tc.IsValid() {
+		return TraceContext{}, fmt.Errorf("invalid traceparent %q: all-zero trace-id or parent-id", s)
+	}
+	return tc, nil
+}
+
+// decodeLowerHex decodes src into dst, reporting whether src is made of
+// exactly 2*len(dst) lowercase hex digits.
+func decodeLowerHex(dst []byte, src string) bool {
+	if len(src) != 2*len(dst) {
+		return false
+	}
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	_, err := hex.Decode(dst, []byte(src))
+	return err == nil
+}
+
+// ParseTraceState validates a tracestate entry, and returns it with optional
+// whitespace and empty list-members removed. An entry with more than 32
+// list-members, a malformed list-member, or a duplicated key is invalid.
+func ParseTraceState(s string) (string, error) {
+	var members []string
+	keys := map[string]struct{}{}
+	for _, member := range strings.Split(s, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(member, "=")
+		if !ok || !validTraceStateKey(key) || !validTraceStateValue(value) {
+			return "", fmt.Errorf("invalid tracestate list-member %q", member)
+		}
+		if _, ok := keys[key]; ok {
+			return "", fmt.Errorf("duplicate tracestate key %q", key)
+		}
+		keys[key] = struct{}{}
+		members = append(members, member)
+	}
+
+	if len(members) > maxTraceStateMembers {
+		return "", fmt.Errorf("tracestate has %d list-members, at most %d are allowed", len(members), maxTraceStateMembers)
+	}
+	return strings.Join(members, ","), nil
+}
+
+// validTraceStateKey reports whether key is a valid simple-key, or
+// multi-tenant key of the form tenant@system.
+func validTraceStateKey(key string) bool {
+	tenant, system, multiTenant := strings.Cut(key, "@")
+	if !multiTenant {
+		return len(key) <= 256 && validTraceStateKeyChars(key, true)
+	}
+	return len(tenant) <= 241 && validTraceStateKeyChars(tenant, false) &&
+		len(system) <= 14 && validTraceStateKeyChars(system, true)
+}
+
+// validTraceStateKeyChars reports whether s is a non-empty string of
+// lowercase letters, digits, and '_', '-', '*', '/', starting with a letter,
+// or with a letter or a digit if letterFirst is false.
+func validTraceStateKeyChars(s string, letterFirst bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9':
+			if i == 0 && letterFirst {
+				return false
+			}
+		case c == '_' || c == '-' || c == '*' || c == '/':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validTraceStateValue reports whether value is made of at most 256 printable
+// ASCII characters other than ',' and '=', and doesn't end with a space.
+func validTraceStateValue(value string) bool {
+	if value == "" || len(value) > 256 || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+type traceContextCtxKey struct{}
+
+// ContextWithTraceContext returns a copy of ctx carrying tc, for use with
+// [W3CTracer].
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextCtxKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context carried by ctx, if any.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextCtxKey{}).(TraceContext)
+	return tc, ok
+}
+
+// W3CTracer is a [Tracer] propagating W3C Trace Context without any tracing
+// library: clients set the trace context of their span with
+// [ContextWithTraceContext], and handlers get the trace context of the span
+// started for their message with [TraceContextFromContext]. It doesn't record
+// spans.
+type W3CTracer struct{}
+
+// Inject implements [Tracer].
+func (W3CTracer) Inject(ctx context.Context, carrier TraceCarrier) {
+	if tc, ok := TraceContextFromContext(ctx); ok {
+		tc.Inject(carrier)
+	}
+}
+
+// Start implements [Tracer]. The span started is a child of the client's span
+// if the client sent a valid trace context, or the root of a new trace
+// otherwise.
+func (W3CTracer) Start(ctx context.Context, carrier TraceCarrier, _ *RequestInfo) (context.Context, func(ErrorCode)) {
+	tc, err := ExtractTraceContext(carrier)
+	if err != nil {
+		tc = TraceContext{}
+		rand.Read(tc.TraceID[:])
+	}
+	rand.Read(tc.SpanID[:])
+	return ContextWithTraceContext(ctx, tc), func(ErrorCode) {}
+}
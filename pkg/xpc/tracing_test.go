@@ -0,0 +1,132 @@
+package xpc
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceCarrier(t *testing.T) {
+	c := TraceCarrier{}
+	assert.Empty(t, c.Keys())
+	assert.Equal(t, "", c.Get("traceparent"))
+
+	c.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.Set("tracestate", "congo=t61rcWkgMzE")
+	assert.Equal(t, []string{"traceparent", "tracestate"}, c.Keys())
+	assert.Equal(t, "congo=t61rcWkgMzE", c.Get("tracestate"))
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(tc.TraceID[:]))
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(tc.SpanID[:]))
+	assert.True(t, tc.Sampled())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tc.TraceParent())
+
+	// Future versions can append fields.
+	tc, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-foo")
+	require.NoError(t, err)
+	assert.False(t, tc.Sampled())
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01foo",
+	} {
+		_, err := ParseTraceParent(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseTraceState(t *testing.T) {
+	state, err := ParseTraceState("congo=t61rcWkgMzE, ,rojo=00f067aa0ba902b7 ,tenant@vendor=x")
+	require.NoError(t, err)
+	assert.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7,tenant@vendor=x", state)
+
+	state, err = ParseTraceState("")
+	require.NoError(t, err)
+	assert.Equal(t, "", state)
+
+	members := make([]string, 33)
+	for i := range members {
+		members[i] = fmt.Sprintf("k%d=v", i)
+	}
+
+	for _, s := range []string{
+		"congo",
+		"Congo=v",
+		"1congo=v",
+		"congo=",
+		"congo=a,b",
+		"congo=v=w",
+		"congo=v,congo=w",
+		"tenant@Vendor=v",
+		strings.Join(members, ","),
+	} {
+		_, err := ParseTraceState(s)
+		assert.Error(t, err, s)
+	}
+
+	_, err = ParseTraceState(strings.Join(members[:32], ","))
+	assert.NoError(t, err)
+}
+
+func TestTraceContextInjectExtract(t *testing.T) {
+	_, err := ExtractTraceContext(TraceCarrier{})
+	assert.Error(t, err)
+
+	// Invalid trace contexts aren't injected.
+	c := TraceCarrier{}
+	TraceContext{}.Inject(c)
+	assert.Empty(t, c)
+
+	tc := TraceContext{Flags: 1, State: "congo=t61rcWkgMzE"}
+	tc.TraceID[0], tc.SpanID[0] = 1, 2
+	tc.Inject(c)
+	got, err := ExtractTraceContext(c)
+	require.NoError(t, err)
+	assert.Equal(t, tc, got)
+
+	// An invalid tracestate is discarded.
+	c.Set("tracestate", "congo")
+	got, err = ExtractTraceContext(c)
+	require.NoError(t, err)
+	assert.Equal(t, "", got.State)
+}
+
+func TestW3CTracer(t *testing.T) {
+	var tracer Tracer = W3CTracer{}
+
+	// Without a trace context, a new trace is started.
+	ctx, end := tracer.Start(context.Background(), TraceCarrier{}, nil)
+	end("")
+	root, ok := TraceContextFromContext(ctx)
+	require.True(t, ok)
+	assert.True(t, root.IsValid())
+
+	c := TraceCarrier{}
+	tracer.Inject(ctx, c)
+	ctx, _ = tracer.Start(context.Background(), c, nil)
+	child, ok := TraceContextFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.NotEqual(t, root.SpanID, child.SpanID)
+
+	// Nothing is injected without a trace context.
+	c = TraceCarrier{}
+	tracer.Inject(context.Background(), c)
+	assert.Empty(t, c)
+}
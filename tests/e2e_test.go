@@ -17,6 +17,8 @@ func TestExampleDaemon(t *testing.T) {
 	}{
 		{"ping", "ping succeeded"},
 		{"add", "3"},
+		{"rpc", "3"},
+		{"oneway", "3"},
 		{"panic", "didn't panic"},
 	}
 